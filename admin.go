@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib/json"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/puzpuzpuz/xsync/v2"
+)
+
+// handleAdminStore lets the relay owner inspect and edit script stores:
+//
+//	GET    /admin/store                       -> summary of all stores
+//	GET    /admin/store/relay                 -> all keys of relay.store
+//	GET    /admin/store/user/<pubkey>         -> all keys of the user store of <pubkey>
+//	PUT    /admin/store/relay/<key>           -> sets a key, body is {"value": ..., "ttl": seconds}
+//	DELETE /admin/store/relay/<key>           -> deletes a key
+//
+// (and the same PUT and DELETE for /admin/store/user/<pubkey>/<key>)
+func handleAdminStore(w http.ResponseWriter, r *http.Request) {
+	body, ok := readOwnerRequest(w, r)
+	if !ok {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/store"), "/")
+	if path == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		writeStoreSummary(w)
+		return
+	}
+
+	var st *store
+	var key string
+	spl := strings.SplitN(path, "/", 3)
+	switch spl[0] {
+	case "relay":
+		st = globalStore
+		key = strings.TrimPrefix(path, "relay")
+	case "user":
+		if len(spl) < 2 || !nostr.IsValid32ByteHex(spl[1]) {
+			http.Error(w, "invalid pubkey", 400)
+			return
+		}
+		key = strings.TrimPrefix(path, "user/"+spl[1])
+		if r.Method == "GET" {
+			// just looking shouldn't keep the store in memory
+			var err error
+			if st, err = lookupUserStore(spl[1]); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		} else {
+			st = getUserStore(spl[1])
+		}
+	default:
+		http.Error(w, "unknown store", 404)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+
+	switch r.Method {
+	case "GET":
+		if key != "" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		writeStoreEntries(w, st)
+	case "PUT":
+		if key == "" {
+			http.Error(w, "missing key", 400)
+			return
+		}
+		o, err := json.Decode(body)
+		if err != nil {
+			http.Error(w, "invalid json: "+err.Error(), 400)
+			return
+		}
+		params, ok := o.(*tengo.Map)
+		if !ok || params.Value["value"] == nil {
+			http.Error(w, "body must be an object with a 'value'", 400)
+			return
+		}
+		ttl, err := ttlFromArgs("admin", []tengo.Object{params.Value["ttl"]}, 0)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := st.set(key, params.Value["value"], ttl); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Info().Str("store", st.name).Str("key", key).Msg("store key set by admin")
+		w.WriteHeader(204)
+	case "DELETE":
+		if key == "" {
+			http.Error(w, "missing key", 400)
+			return
+		}
+		if err := st.del(key); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Info().Str("store", st.name).Str("key", key).Msg("store key deleted by admin")
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func writeStoreEntries(w http.ResponseWriter, st *store) {
+	type entry struct {
+		Key   string             `json:"key"`
+		Value stdjson.RawMessage `json:"value"`
+		TTL   int64              `json:"ttl,omitempty"`
+	}
+
+	dump := st.dump()
+	entries := make([]entry, 0, len(dump))
+	for key, item := range dump {
+		j, err := json.Encode(item.value)
+		if err != nil {
+			j, _ = stdjson.Marshal(item.value.String())
+		}
+		entries = append(entries, entry{Key: key, Value: j, TTL: int64(item.ttl.Seconds())})
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return strings.Compare(a.Key, b.Key) })
+
+	w.Header().Set("Content-Type", "application/json")
+	stdjson.NewEncoder(w).Encode(entries)
+}
+
+func writeStoreSummary(w http.ResponseWriter) {
+	type connection struct {
+		IP     string `json:"ip"`
+		Authed string `json:"authed,omitempty"`
+		Keys   int    `json:"keys"`
+	}
+	summary := struct {
+		Relay       int            `json:"relay"`
+		Users       map[string]int `json:"users"`
+		Connections []connection   `json:"connections"`
+	}{
+		Relay:       len(globalStore.keys("")),
+		Users:       make(map[string]int),
+		Connections: make([]connection, 0),
+	}
+
+	// user stores that aren't in memory are counted from kv
+	if kv != nil {
+		now := time.Now().Unix()
+		err := readKV("user/", func(fullKey string, value []byte) {
+			pubkey, _, _ := strings.Cut(strings.TrimPrefix(fullKey, "user/"), "/")
+			if _, loaded := userStores.Load(pubkey); loaded {
+				return
+			}
+			entry := storedEntry{}
+			if err := stdjson.Unmarshal(value, &entry); err == nil && (entry.Expires == 0 || entry.Expires > now) {
+				summary.Users[pubkey]++
+			}
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	userStores.Range(func(pubkey string, st *store) bool {
+		if n := len(st.keys("")); n > 0 {
+			summary.Users[pubkey] = n
+		}
+		return true
+	})
+	sessionStorage.Range(func(ws *khatru.WebSocket, st *store) bool {
+		summary.Connections = append(summary.Connections, connection{
+			IP:     khatru.GetIPFromRequest(ws.Request),
+			Authed: ws.AuthedPublicKey,
+			Keys:   len(st.keys("")),
+		})
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	stdjson.NewEncoder(w).Encode(summary)
+}
+
+// handleAdminTrace lets the relay owner see how scripts decide on what a pubkey or ip does:
+//
+//	GET    /admin/trace             -> everything being traced
+//	PUT    /admin/trace/<target>    -> starts tracing a pubkey or ip, body is {"ttl": seconds}
+//	GET    /admin/trace/<target>    -> the last script evaluations involving the target
+//	DELETE /admin/trace/<target>    -> stops tracing
+func handleAdminTrace(w http.ResponseWriter, r *http.Request) {
+	body, ok := readOwnerRequest(w, r)
+	if !ok {
+		return
+	}
+
+	target := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/trace"), "/")
+	if target == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		writeTraceSummary(w)
+		return
+	}
+	if !nostr.IsValid32ByteHex(target) && net.ParseIP(target) == nil {
+		http.Error(w, "target must be a hex pubkey or an ip", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		entries := traceEntries(target)
+		if entries == nil {
+			http.Error(w, "not being traced", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		stdjson.NewEncoder(w).Encode(entries)
+	case "PUT":
+		ttl := 10 * time.Minute
+		if len(body) > 0 {
+			var params struct {
+				TTL int64 `json:"ttl"`
+			}
+			if err := stdjson.Unmarshal(body, &params); err != nil {
+				http.Error(w, "invalid json: "+err.Error(), 400)
+				return
+			}
+			if params.TTL > 0 {
+				ttl = time.Duration(params.TTL) * time.Second
+			}
+		}
+		startTracing(target, ttl)
+		log.Info().Str("target", target).Stringer("ttl", ttl).Msg("tracing started by admin")
+		w.WriteHeader(204)
+	case "DELETE":
+		tracers.Delete(target)
+		log.Info().Str("target", target).Msg("tracing stopped by admin")
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func writeTraceSummary(w http.ResponseWriter) {
+	type trace struct {
+		Target  string    `json:"target"`
+		Until   time.Time `json:"until"`
+		Entries int       `json:"entries"`
+	}
+
+	now := time.Now()
+	traces := make([]trace, 0, tracers.Size())
+	tracers.Range(func(target string, tr *tracer) bool {
+		if now.After(tr.until) {
+			tracers.Delete(target)
+			return true
+		}
+		tr.mutex.Lock()
+		traces = append(traces, trace{Target: target, Until: tr.until, Entries: len(tr.entries)})
+		tr.mutex.Unlock()
+		return true
+	})
+	slices.SortFunc(traces, func(a, b trace) int { return strings.Compare(a.Target, b.Target) })
+
+	w.Header().Set("Content-Type", "application/json")
+	stdjson.NewEncoder(w).Encode(traces)
+}
+
+// unsetRelayPubkey is the default for --pubkey, its secret key is 1 so anyone can sign as it
+const unsetRelayPubkey = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+
+// maxAdminBody is the most the admin endpoints read from a request body
+const maxAdminBody = 64 * 1024
+
+var errNoOwner = fmt.Errorf("the relay owner is not set, use --pubkey")
+
+// usedAuthEvents has the ids of the NIP-98 events that were accepted, until they are too old
+// to be accepted anyway, so each can only be used once
+var usedAuthEvents = xsync.NewMapOf[nostr.Timestamp]()
+
+func hasOwner() bool {
+	return s.RelayPubkey != "" && s.RelayPubkey != unsetRelayPubkey
+}
+
+// readOwnerRequest reads the body of a request to the admin endpoints and checks that it
+// comes from the relay owner, if not it writes the error and returns false
+func readOwnerRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if !hasOwner() {
+		http.Error(w, errNoOwner.Error(), 403)
+		return nil, false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, "failed to read body", 413)
+		return nil, false
+	}
+	if err := checkOwnerAuth(r, body); err != nil {
+		http.Error(w, err.Error(), 401)
+		return nil, false
+	}
+	return body, true
+}
+
+// checkOwnerAuth validates a NIP-98 Authorization header and checks that it was signed by the relay owner
+func checkOwnerAuth(r *http.Request, body []byte) error {
+	if !hasOwner() {
+		return errNoOwner
+	}
+
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return fmt.Errorf("missing auth")
+	}
+
+	var evt nostr.Event
+	if evtj, err := base64.StdEncoding.DecodeString(auth); err != nil {
+		return fmt.Errorf("invalid base64 auth")
+	} else if err := stdjson.Unmarshal(evtj, &evt); err != nil {
+		return fmt.Errorf("invalid auth event json")
+	} else if evt.Kind != 27235 {
+		return fmt.Errorf("auth event must be kind 27235")
+	} else if evt.ID != evt.GetID() {
+		// the signature doesn't cover the id, but used auth events are remembered by it
+		return fmt.Errorf("invalid auth event id")
+	} else if ok, _ := evt.CheckSignature(); !ok {
+		return fmt.Errorf("invalid auth event signature")
+	} else if evt.PubKey != s.RelayPubkey {
+		return fmt.Errorf("only the relay owner can do this")
+	} else if evt.CreatedAt < nostr.Now()-60 || evt.CreatedAt > nostr.Now()+60 {
+		return fmt.Errorf("auth event is too old or too new")
+	}
+
+	if u := evt.Tags.GetFirst([]string{"u", ""}); u == nil || (*u)[1] != getServiceBaseURL(r)+r.URL.RequestURI() {
+		return fmt.Errorf("invalid 'u' tag")
+	}
+	if m := evt.Tags.GetFirst([]string{"method", ""}); m == nil || !strings.EqualFold((*m)[1], r.Method) {
+		return fmt.Errorf("invalid 'method' tag")
+	}
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		if evt.Tags.GetFirst([]string{"payload", hex.EncodeToString(hash[:])}) == nil {
+			return fmt.Errorf("invalid 'payload' tag")
+		}
+	}
+
+	now := nostr.Now()
+	usedAuthEvents.Range(func(id string, expires nostr.Timestamp) bool {
+		if expires < now {
+			usedAuthEvents.Delete(id)
+		}
+		return true
+	})
+	if _, used := usedAuthEvents.LoadOrStore(evt.ID, evt.CreatedAt+60); used {
+		return fmt.Errorf("auth event was already used")
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckOwnerAuth(t *testing.T) {
+	ownerSecret := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSecret)
+	otherSecret := nostr.GeneratePrivateKey()
+
+	previousOwner := s.RelayPubkey
+	s.ServiceURL = "https://relay.example.com"
+	defer func() {
+		s.ServiceURL = ""
+		s.RelayPubkey = previousOwner
+	}()
+
+	const url = "https://relay.example.com/admin/store/relay/x"
+	body := `{"value":1}`
+	payload := sha256.Sum256([]byte(body))
+
+	authEvent := func(secret string, modify func(*nostr.Event)) string {
+		evt := nostr.Event{
+			Kind:      27235,
+			CreatedAt: nostr.Now(),
+			Tags: nostr.Tags{
+				{"u", url},
+				{"method", "PUT"},
+				{"payload", hex.EncodeToString(payload[:])},
+			},
+		}
+		if modify != nil {
+			modify(&evt)
+		}
+		evt.Sign(secret)
+		j, _ := stdjson.Marshal(evt)
+		return "Nostr " + base64.StdEncoding.EncodeToString(j)
+	}
+	reused := authEvent(ownerSecret, nil)
+
+	// the same signed event with another id
+	withID := func(auth string, id string) string {
+		j, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Nostr "))
+		var evt nostr.Event
+		stdjson.Unmarshal(j, &evt)
+		evt.ID = id
+		j, _ = stdjson.Marshal(evt)
+		return "Nostr " + base64.StdEncoding.EncodeToString(j)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		owner  string
+		auth   string
+		method string
+		body   string
+		err    string
+	}{
+		{"first use", owner, reused, "PUT", body, ""},
+		{"replayed", owner, reused, "PUT", body, "already used"},
+		{"replayed with another id", owner, withID(reused, strings.Repeat("0", 64)), "PUT", body, "invalid auth event id"},
+		{"replayed without an id", owner, withID(reused, ""), "PUT", body, "invalid auth event id"},
+		{"no owner", "", authEvent(ownerSecret, nil), "PUT", body, "not set"},
+		{"default owner", unsetRelayPubkey, authEvent("0000000000000000000000000000000000000000000000000000000000000001", nil), "PUT", body, "not set"},
+		{"missing auth", owner, "", "PUT", body, "missing auth"},
+		{"bad base64", owner, "Nostr !!!", "PUT", body, "invalid base64"},
+		{"not the owner", owner, authEvent(otherSecret, nil), "PUT", body, "only the relay owner"},
+		{"wrong kind", owner, authEvent(ownerSecret, func(evt *nostr.Event) { evt.Kind = 1 }), "PUT", body, "kind 27235"},
+		{"too old", owner, authEvent(ownerSecret, func(evt *nostr.Event) { evt.CreatedAt -= 120 }), "PUT", body, "too old"},
+		{"wrong url", owner, authEvent(ownerSecret, func(evt *nostr.Event) { evt.Tags[0][1] = url + "y" }), "PUT", body, "'u' tag"},
+		{"wrong method", owner, authEvent(ownerSecret, nil), "DELETE", body, "'method' tag"},
+		{"wrong payload", owner, authEvent(ownerSecret, nil), "PUT", `{"value":2}`, "'payload' tag"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s.RelayPubkey = tc.owner
+			r := httptest.NewRequest(tc.method, url, strings.NewReader(tc.body))
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+
+			err := checkOwnerAuth(r, []byte(tc.body))
+			if tc.err == "" && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected an error with '%s', got %v", tc.err, err)
+			}
+		})
+	}
+}
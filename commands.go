@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/urfave/cli/v2"
+)
+
+var exportCommand = &cli.Command{
+	Name:  "export",
+	Usage: "writes events from the database to stdout, one JSON event per line",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "filter",
+			Usage: "only export the events matching this nostr filter, given as JSON",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		closeLogs, err := setupLogging(os.Stderr)
+		if err != nil {
+			return err
+		}
+		defer closeLogs()
+
+		filter := nostr.Filter{}
+		if f := c.String("filter"); f != "" {
+			if err := stdjson.Unmarshal([]byte(f), &filter); err != nil {
+				return fmt.Errorf("invalid filter: %w", err)
+			}
+		}
+
+		if err := openDatabase(); err != nil {
+			return err
+		}
+		defer db.Close()
+
+		out := bufio.NewWriter(os.Stdout)
+		count := 0
+		err = iterateEvents(c.Context, db, filter, func(evt *nostr.Event) error {
+			j, err := stdjson.Marshal(evt)
+			if err != nil {
+				return err
+			}
+			if _, err := out.Write(append(j, '\n')); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			// what was exported before failing is still written
+			out.Flush()
+			return fmt.Errorf("failed after exporting %d events: %w", count, err)
+		}
+		if err := out.Flush(); err != nil {
+			return fmt.Errorf("failed to write the exported events: %w", err)
+		}
+		log.Info().Msgf("exported %d events", count)
+		return nil
+	},
+}
+
+var importCommand = &cli.Command{
+	Name:  "import",
+	Usage: "reads events from stdin, one JSON event per line, and saves them to the database",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "check",
+			Usage: "pass each event through reject-event.tengo and skip the ones it rejects",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		closeLogs, err := setupLogging(os.Stderr)
+		if err != nil {
+			return err
+		}
+		defer closeLogs()
+
+		if err := openDatabase(); err != nil {
+			return err
+		}
+		defer db.Close()
+
+		check := c.Bool("check")
+		if check {
+			if _, err := os.Stat(filepath.Join(s.CustomDirectory, string(REJECT_EVENT))); err != nil {
+				return fmt.Errorf("can't check events without %s: %w", REJECT_EVENT, err)
+			}
+			// scripts may want to use their stores
+			if err := openScriptStores(); err != nil {
+				return err
+			}
+			defer closeScriptStores()
+		}
+
+		var imported, duplicate, skipped, rejected, invalid int
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			evt := &nostr.Event{}
+			if err := stdjson.Unmarshal(scanner.Bytes(), evt); err != nil {
+				log.Warn().Err(err).Int("line", line).Msg("invalid json")
+				invalid++
+				continue
+			}
+			if !evt.CheckID() {
+				log.Warn().Int("line", line).Str("id", evt.ID).Msg("invalid id")
+				invalid++
+				continue
+			}
+			if ok, _ := evt.CheckSignature(); !ok {
+				log.Warn().Int("line", line).Str("id", evt.ID).Msg("invalid signature")
+				invalid++
+				continue
+			}
+			if evt.IsEphemeral() {
+				skipped++
+				continue
+			}
+
+			if check {
+				if reject, msg := rejectEvent(context.Background(), evt); reject {
+					log.Info().Int("line", line).Str("id", evt.ID).Str("reason", msg).Msg("rejected")
+					rejected++
+					continue
+				}
+			}
+
+			switch err := storeEvent(c.Context, db, evt); {
+			case err == nil:
+				imported++
+			case errors.Is(err, eventstore.ErrDupEvent):
+				duplicate++
+			case errors.Is(err, errNewerVersion):
+				skipped++
+			default:
+				return fmt.Errorf("failed to save event from line %d: %w", line, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+
+		log.Info().
+			Int("imported", imported).
+			Int("duplicate", duplicate).
+			Int("skipped", skipped).
+			Int("rejected", rejected).
+			Int("invalid", invalid).
+			Msg("import finished")
+		return nil
+	},
+}
+
+// migrateCheckpoint is saved while migrating so an interrupted migration can be resumed
+type migrateCheckpoint struct {
+	From    string `json:"from"`
+	FromURI string `json:"from_uri"`
+	To      string `json:"to"`
+	ToURI   string `json:"to_uri"`
+
+	// events are copied in passes, newest first, each from the newest event in the source
+	// down to Since, where SinceIDs were already copied by the previous passes. Top is where
+	// the current pass started, with TopIDs the events there it copied, Until is how far it
+	// got and UntilIDs are the events at Until that were already copied
+	Since    nostr.Timestamp `json:"since"`
+	SinceIDs []string        `json:"since_ids"`
+	Top      nostr.Timestamp `json:"top"`
+	TopIDs   []string        `json:"top_ids"`
+	Until    nostr.Timestamp `json:"until"`
+	UntilIDs []string        `json:"until_ids"`
+
+	Copied    int `json:"copied"`
+	Duplicate int `json:"duplicate"`
+	Skipped   int `json:"skipped"`
+}
+
+var migrateCommand = &cli.Command{
+	Name:  "migrate",
+	Usage: "copies all events from one database to another, badger and lmdb databases can't be in use by a running relay",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "from",
+			Usage:    "database to copy from ('sqlite', 'lmdb', 'badger' or 'postgres')",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:        "from-uri",
+			Usage:       "like --database-uri, for the database being copied from",
+			DefaultText: "the name of the database driver",
+		},
+		&cli.StringFlag{
+			Name:     "to",
+			Usage:    "database to copy to ('sqlite', 'lmdb', 'badger' or 'postgres')",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:        "to-uri",
+			Usage:       "like --database-uri, for the database being copied to",
+			DefaultText: "the name of the database driver",
+		},
+		&cli.BoolFlag{
+			Name:  "restart",
+			Usage: "start from the beginning instead of resuming an interrupted migration",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		closeLogs, err := setupLogging(os.Stderr)
+		if err != nil {
+			return err
+		}
+		defer closeLogs()
+
+		cp := migrateCheckpoint{
+			From:    c.String("from"),
+			FromURI: c.String("from-uri"),
+			To:      c.String("to"),
+			ToURI:   c.String("to-uri"),
+		}
+		if cp.From == "memory" || cp.To == "memory" {
+			return fmt.Errorf("can't migrate from or to the memory database")
+		}
+		if cp.From == cp.To && cp.FromURI == cp.ToURI {
+			return fmt.Errorf("--from and --to are the same database")
+		}
+		if err := os.MkdirAll(s.DataDirectory, 0700); err != nil {
+			return fmt.Errorf("failed to create datadir '%s': %w", s.DataDirectory, err)
+		}
+
+		src, srcLocation, err := makeEventStore(cp.From, cp.FromURI)
+		if err != nil {
+			return fmt.Errorf("--from: %w", err)
+		}
+		if err := src.Init(); err != nil {
+			return fmt.Errorf("failed to initialize %s: %w", cp.From, err)
+		}
+		defer src.Close()
+		dst, dstLocation, err := makeEventStore(cp.To, cp.ToURI)
+		if err != nil {
+			return fmt.Errorf("--to: %w", err)
+		}
+		if err := dst.Init(); err != nil {
+			return fmt.Errorf("failed to initialize %s: %w", cp.To, err)
+		}
+		defer dst.Close()
+
+		cpath := filepath.Join(s.DataDirectory, "migrate.checkpoint")
+		if !c.Bool("restart") {
+			if j, err := os.ReadFile(cpath); err == nil {
+				previous := migrateCheckpoint{}
+				if err := stdjson.Unmarshal(j, &previous); err != nil {
+					return fmt.Errorf("invalid checkpoint at %s, use --restart: %w", cpath, err)
+				}
+				if previous.From != cp.From || previous.FromURI != cp.FromURI ||
+					previous.To != cp.To || previous.ToURI != cp.ToURI {
+					return fmt.Errorf("%s is from a migration between other databases, use --restart to ignore it", cpath)
+				}
+				cp = previous
+			}
+		}
+		saveCheckpoint := func() error {
+			j, _ := stdjson.Marshal(cp)
+			return os.WriteFile(cpath, j, 0600)
+		}
+
+		total, err := countEvents(c.Context, src, nostr.Filter{})
+		if err != nil {
+			return fmt.Errorf("failed to count events in %s: %w", cp.From, err)
+		}
+		log.Info().Msgf("copying %d events from %s in %s to %s in %s", total, cp.From, srcLocation, cp.To, dstLocation)
+
+		if cp.Until != 0 {
+			log.Info().Msgf("resuming from %s, after %d events", cp.Until.Time().Format(time.RFC3339), cp.Copied+cp.Duplicate+cp.Skipped)
+		}
+
+		lastReport := time.Now()
+		copyEvent := func(evt *nostr.Event) error {
+			if evt.CreatedAt == cp.Until && slices.Contains(cp.UntilIDs, evt.ID) {
+				// copied before the migration was interrupted
+				return nil
+			}
+			if evt.CreatedAt == cp.Since && slices.Contains(cp.SinceIDs, evt.ID) {
+				// copied by a previous pass
+				return nil
+			}
+
+			switch err := storeEvent(c.Context, dst, evt); {
+			case err == nil:
+				cp.Copied++
+			case errors.Is(err, eventstore.ErrDupEvent):
+				cp.Duplicate++
+			case errors.Is(err, errNewerVersion):
+				cp.Skipped++
+			default:
+				return fmt.Errorf("failed to save event %s: %w", evt.ID, err)
+			}
+			if cp.Until == 0 {
+				cp.Top = evt.CreatedAt
+			}
+			if evt.CreatedAt == cp.Top {
+				cp.TopIDs = append(cp.TopIDs, evt.ID)
+			}
+			if evt.CreatedAt != cp.Until {
+				cp.Until = evt.CreatedAt
+				cp.UntilIDs = cp.UntilIDs[:0]
+			}
+			cp.UntilIDs = append(cp.UntilIDs, evt.ID)
+
+			done := cp.Copied + cp.Duplicate + cp.Skipped
+			if done%1000 == 0 {
+				if err := saveCheckpoint(); err != nil {
+					return fmt.Errorf("failed to save checkpoint: %w", err)
+				}
+			}
+			if time.Since(lastReport) > 5*time.Second {
+				lastReport = time.Now()
+				log.Info().Msgf("%d of %d events done, now at %s", done, total, cp.Until.Time().Format(time.RFC3339))
+			}
+			return nil
+		}
+
+		for {
+			// events that are newer than where a pass started (or in the same second) were saved
+			// while it was running, so they are copied by another pass until one finds nothing new
+			resuming := cp.Until != 0
+			before := cp.Copied + cp.Duplicate + cp.Skipped
+
+			filter := nostr.Filter{}
+			if cp.Since != 0 {
+				filter.Since = &cp.Since
+			}
+			if resuming {
+				until := cp.Until
+				filter.Until = &until
+			}
+			err = iterateEvents(c.Context, src, filter, copyEvent)
+			if err != nil {
+				break
+			}
+
+			if !resuming && cp.Copied+cp.Duplicate+cp.Skipped == before {
+				break
+			}
+			if cp.Top == cp.Since {
+				cp.SinceIDs = append(cp.SinceIDs, cp.TopIDs...)
+			} else {
+				cp.SinceIDs = cp.TopIDs
+			}
+			cp.Since = cp.Top
+			cp.Top = 0
+			cp.TopIDs = nil
+			cp.Until = 0
+			cp.UntilIDs = nil
+		}
+		if err != nil {
+			saveCheckpoint()
+			return fmt.Errorf("migration interrupted, run it again to resume: %w", err)
+		}
+
+		log.Info().
+			Int("copied", cp.Copied).
+			Int("duplicate", cp.Duplicate).
+			Int("skipped", cp.Skipped).
+			Msg("migration finished")
+
+		srcCount, err := countEvents(c.Context, src, nostr.Filter{})
+		if err != nil {
+			return fmt.Errorf("failed to count events in %s: %w", cp.From, err)
+		}
+		dstCount, err := countEvents(c.Context, dst, nostr.Filter{})
+		if err != nil {
+			return fmt.Errorf("failed to count events in %s: %w", cp.To, err)
+		}
+		log.Info().Msgf("%s has %d events, %s has %d events", cp.From, srcCount, cp.To, dstCount)
+		if dstCount < srcCount-int64(cp.Skipped) {
+			// these may have been saved while migrating with a created_at older than where the
+			// passes were, so the next run goes through all the events again
+			cp.Since = 0
+			cp.SinceIDs = nil
+			if err := saveCheckpoint(); err != nil {
+				return fmt.Errorf("failed to save checkpoint: %w", err)
+			}
+			return fmt.Errorf("%s is missing %d events, run the migration again to copy them", cp.To, srcCount-int64(cp.Skipped)-dstCount)
+		}
+		os.Remove(cpath)
+		return nil
+	},
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// openDatabase initializes the database chosen with --db (and the ones in --stores) as db
+func openDatabase() error {
+	if err := os.MkdirAll(s.DataDirectory, 0700); err != nil {
+		return fmt.Errorf("failed to create datadir '%s': %w", s.DataDirectory, err)
+	}
+	es, location, err := makeEventStore(s.DatabaseBackend, s.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	db = es
+	if s.ExtraStores != "" || s.KindRoutes != "" {
+		r, err := makeRouter(es, s.ExtraStores, s.KindRoutes)
+		if err != nil {
+			return err
+		}
+		db = r
+	}
+	if err := db.Init(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	log.Info().Msgf("storing data with %s in %s", s.DatabaseBackend, location)
+	return nil
+}
+
+// openScriptStores initializes kv and loads everything scripts have stored from it
+func openScriptStores() error {
+	kvpath := filepath.Join(s.DataDirectory, "store-"+s.DatabaseBackend)
+	if s.DatabaseBackend == "postgres" || s.DatabaseBackend == "postgresql" {
+		// this one goes in a table in the same database
+		kvpath = s.DatabaseURL
+	}
+	kvb, err := makeKVBackend(s.DatabaseBackend, kvpath)
+	if err != nil {
+		return err
+	}
+	if err := kvb.Init(); err != nil {
+		return fmt.Errorf("failed to initialize script store: %w", err)
+	}
+	kv = kvb
+	if err := loadStores(); err != nil {
+		kv.Close()
+		return fmt.Errorf("failed to load script store: %w", err)
+	}
+	return nil
+}
+
+// makeEventStore creates (but doesn't initialize) the eventstore for a backend. uri is a path
+// under --datadir for the local databases and a DSN for postgres, location describes where the
+// data will be for logging
+func makeEventStore(backend string, uri string) (eventstore.Store, string, error) {
+	local := func() string {
+		if uri == "" {
+			uri = backend
+		}
+		return filepath.Join(s.DataDirectory, uri)
+	}
+
+	switch backend {
+	case "sqlite", "sqlite3":
+		path := local()
+		return &sqlite3.SQLite3Backend{DatabaseURL: path, QueryLimit: storeQueryLimit}, "./" + path, nil
+	case "lmdb":
+		path := local()
+		return &lmdb.LMDBBackend{Path: path, MaxLimit: storeQueryLimit}, "./" + path, nil
+	case "badger":
+		path := local()
+		return &badger.BadgerBackend{Path: path, MaxLimit: storeQueryLimit}, "./" + path, nil
+	case "postgres", "postgresql":
+		if uri == "" {
+			return nil, "", fmt.Errorf("the postgres database needs --database-uri to be set to a connection string")
+		}
+		return &postgresql.PostgresBackend{DatabaseURL: uri, QueryLimit: storeQueryLimit},
+			"the database at --database-uri", nil
+	case "memory":
+		return &memoryStore{SliceStore: slicestore.SliceStore{MaxLimit: storeQueryLimit}},
+			"RAM (everything will be lost on restart)", nil
+	default:
+		return nil, "", fmt.Errorf("unknown option '%s' for database", backend)
+	}
+}
+
+// storeQueryLimit is how many events the stores return for a query at most. it is much higher
+// than the backends' own limits so iterateEvents can always get all the events created in the
+// same second, clients still get the usual limits through clientQueryEvents
+const storeQueryLimit = 1_000_000
+
+// clientQueryEvents queries the stores for clients with the limits the backend has by default:
+// how many events are returned when a filter has no limit, and the highest limit it takes
+func clientQueryEvents(es eventstore.Store, backend string) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	defaultLimit, maxLimit := 500, 500
+	switch backend {
+	case "sqlite", "sqlite3", "postgres", "postgresql":
+		defaultLimit, maxLimit = 100, 100
+	case "lmdb", "badger":
+		defaultLimit, maxLimit = 125, 499
+	}
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Limit < 1 || filter.Limit > maxLimit {
+			filter.Limit = defaultLimit
+		}
+		return es.QueryEvents(ctx, filter)
+	}
+}
+
+// memoryStore is a slicestore that can be used by many connections at the same time
+type memoryStore struct {
+	slicestore.SliceStore
+	mutex sync.RWMutex
+}
+
+func (m *memoryStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	m.mutex.RLock()
+	// the slicestore doesn't close the channel when its context is canceled, so it can't get ours
+	results, err := m.SliceStore.QueryEvents(context.Background(), filter)
+	if err != nil {
+		m.mutex.RUnlock()
+		return nil, err
+	}
+
+	// all the results are read while the lock is held, only then they are sent
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		events := make([]*nostr.Event, 0, 20)
+		for evt := range results {
+			events = append(events, evt)
+		}
+		m.mutex.RUnlock()
+
+		for _, evt := range events {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (m *memoryStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.SliceStore.CountEvents(ctx, filter)
+}
+
+func (m *memoryStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.SliceStore.SaveEvent(ctx, evt)
+}
+
+func (m *memoryStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.SliceStore.DeleteEvent(ctx, evt)
+}
+
+// iterateEvents calls fn with every event matching the filter, newest first, going through
+// the database in pages instead of asking for all of them at once.
+// filter.Limit, if set, is the total number of events
+func iterateEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, fn func(*nostr.Event) error) error {
+	const pageSize = 100
+	total := 0
+
+	// each page starts at the oldest timestamp of the previous, so these are the events
+	// with that timestamp that were already given to fn
+	seen := make(map[string]struct{})
+
+	page := filter
+	page.Limit = pageSize
+	page.LimitZero = false
+	for {
+		ch, err := store.QueryEvents(ctx, page)
+		if err != nil {
+			return err
+		}
+		events := make([]*nostr.Event, 0, page.Limit)
+		for evt := range ch {
+			events = append(events, evt)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		fresh := 0
+		oldest := events[0].CreatedAt
+		for _, evt := range events {
+			oldest = min(oldest, evt.CreatedAt)
+			if _, ok := seen[evt.ID]; ok {
+				continue
+			}
+			fresh++
+			if err := fn(evt); err != nil {
+				return err
+			}
+			total++
+			if filter.Limit > 0 && total >= filter.Limit {
+				return nil
+			}
+		}
+
+		if fresh == 0 {
+			// the page only had events at page.Until that were already given to fn, there may
+			// be more of them than fit in a page, so they are all asked for at once
+			n, err := countAt(ctx, store, filter, oldest, len(events) < page.Limit)
+			if err != nil {
+				return err
+			}
+			if n > len(seen) {
+				if page.Limit >= n {
+					return fmt.Errorf("there are %d events at %d and the database won't return more than %d of them",
+						n, oldest, len(seen))
+				}
+				page.Limit = n
+				continue
+			}
+			page.Limit = pageSize
+			oldest--
+		}
+		if page.Until == nil || *page.Until != oldest {
+			clear(seen)
+		}
+		for _, evt := range events {
+			if evt.CreatedAt == oldest {
+				seen[evt.ID] = struct{}{}
+			}
+		}
+		page.Until = &oldest
+	}
+}
+
+// countAt counts the events matching the filter that were created at the given timestamp.
+// stores that can't count are trusted to have given all of them if the page wasn't full
+func countAt(ctx context.Context, store eventstore.Store, filter nostr.Filter, ts nostr.Timestamp, partial bool) (int, error) {
+	counter, ok := store.(eventstore.Counter)
+	if !ok {
+		if partial {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("there may be more events at %d than fit in a page and the database can't count them", ts)
+	}
+	filter.Since = &ts
+	filter.Until = &ts
+	filter.Limit = 0
+	filter.LimitZero = false
+	n, err := counter.CountEvents(ctx, filter)
+	return int(n), err
+}
+
+// countEvents counts the events matching the filter, going through all of them if the store
+// can't count by itself
+func countEvents(ctx context.Context, es eventstore.Store, filter nostr.Filter) (int64, error) {
+	if counter, ok := es.(eventstore.Counter); ok {
+		return counter.CountEvents(ctx, filter)
+	}
+	var count int64
+	err := iterateEvents(ctx, es, filter, func(*nostr.Event) error {
+		count++
+		return nil
+	})
+	return count, err
+}
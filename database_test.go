@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// openTestStore makes and initializes a store under a temporary --datadir. lmdb is left open:
+// its queries end their read transactions after the last result is sent, and closing it right
+// after that can crash
+func openTestStore(t *testing.T, backend string) eventstore.Store {
+	t.Helper()
+	s.DataDirectory = t.TempDir()
+	t.Cleanup(func() { s.DataDirectory = "" })
+	store, _, err := makeEventStore(backend, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.Init(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if backend != "lmdb" {
+		t.Cleanup(store.Close)
+	}
+	return store
+}
+
+func TestIterateEvents(t *testing.T) {
+	ctx := context.Background()
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	// events are given as how many of them are created at each timestamp
+	makeEvents := func(timestamps map[nostr.Timestamp]int) []*nostr.Event {
+		events := make([]*nostr.Event, 0, 100)
+		for ts, n := range timestamps {
+			for i := 0; i < n; i++ {
+				evt := &nostr.Event{
+					PubKey:    pubkey,
+					Kind:      1,
+					CreatedAt: ts,
+					Tags:      nostr.Tags{},
+					Content:   fmt.Sprintf("%d/%d", ts, i),
+				}
+				evt.ID = evt.GetID()
+				events = append(events, evt)
+			}
+		}
+		return events
+	}
+
+	spread := make(map[nostr.Timestamp]int)
+	for ts := nostr.Timestamp(1); ts <= 250; ts++ {
+		spread[ts] = 1 + int(ts)%3
+	}
+
+	for _, backend := range []string{"memory", "sqlite", "lmdb", "badger"} {
+		for _, tc := range []struct {
+			name       string
+			timestamps map[nostr.Timestamp]int
+			limit      int
+			expected   int
+		}{
+			{"empty", nil, 0, 0},
+			{"spread", spread, 0, 500},
+			{"limit", spread, 150, 150},
+			{"exactly a page at one timestamp", map[nostr.Timestamp]int{10: 50, 20: 100, 30: 50}, 0, 200},
+			{"more than a page at one timestamp", map[nostr.Timestamp]int{10: 50, 20: 150, 30: 50}, 0, 250},
+			// more than the backends return by default
+			{"many at one timestamp", map[nostr.Timestamp]int{10: 10, 20: 600, 30: 10}, 0, 620},
+		} {
+			t.Run(backend+"/"+tc.name, func(t *testing.T) {
+				store := openTestStore(t, backend)
+				for _, evt := range makeEvents(tc.timestamps) {
+					if err := store.SaveEvent(ctx, evt); err != nil {
+						t.Fatalf("unexpected error saving: %s", err)
+					}
+				}
+
+				got := make(map[string]struct{})
+				last := nostr.Timestamp(1 << 32)
+				err := iterateEvents(ctx, store, nostr.Filter{Limit: tc.limit}, func(evt *nostr.Event) error {
+					if _, ok := got[evt.ID]; ok {
+						return fmt.Errorf("event %s given twice", evt.ID)
+					}
+					if evt.CreatedAt > last {
+						return fmt.Errorf("event at %d given after one at %d", evt.CreatedAt, last)
+					}
+					got[evt.ID] = struct{}{}
+					last = evt.CreatedAt
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if len(got) != tc.expected {
+					t.Fatalf("expected %d events, got %d", tc.expected, len(got))
+				}
+			})
+		}
+	}
+}
+
+func TestClientQueryEvents(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	// what the backends return with their own limits, for filters with these limits
+	limits := []int{0, 50, 200, 499, 500, 1000}
+	for _, tc := range []struct {
+		backend  string
+		expected []int
+	}{
+		{"memory", []int{500, 50, 200, 499, 500, 500}},
+		{"sqlite", []int{100, 50, 100, 100, 100, 100}},
+		{"lmdb", []int{125, 50, 200, 499, 125, 125}},
+		{"badger", []int{125, 50, 200, 499, 125, 125}},
+	} {
+		t.Run(tc.backend, func(t *testing.T) {
+			store := openTestStore(t, tc.backend)
+			for i := 0; i < 600; i++ {
+				evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Timestamp(1000 + i), Tags: nostr.Tags{}}
+				evt.Sign(sk)
+				if err := store.SaveEvent(ctx, evt); err != nil {
+					t.Fatalf("unexpected error saving: %s", err)
+				}
+			}
+
+			query := clientQueryEvents(store, tc.backend)
+			for i, limit := range limits {
+				ch, err := query(ctx, nostr.Filter{Limit: limit})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				n := 0
+				for range ch {
+					n++
+				}
+				if n != tc.expected[i] {
+					t.Errorf("expected %d events with limit %d, got %d", tc.expected[i], limit, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/dgraph-io/badger/v4"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// kvBackend is where script stores are persisted. it mirrors whatever is chosen with --db
+// but it is kept in a separate database so it doesn't interfere with the eventstore
+type kvBackend interface {
+	Init() error
+	Close()
+	Iterate(prefix string, fn func(key string, value []byte)) error
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+var kv kvBackend
+
+// writes to kv are queued and done in the background so scripts don't wait for the disk
+// while holding a store lock. only the latest value of each key is kept in the queue
+var (
+	kvQueue      = make(map[string][]byte) // a nil value deletes the key
+	kvQueueMutex sync.Mutex
+
+	// flushes happen one at a time so the writes to a key are done in order
+	kvFlushMutex sync.Mutex
+)
+
+func queueKVWrite(key string, value []byte) {
+	kvQueueMutex.Lock()
+	kvQueue[key] = value
+	kvQueueMutex.Unlock()
+}
+
+// flushKV writes everything that was queued. keys that fail to be written are queued
+// again, unless they were changed in the meantime
+func flushKV() error {
+	kvFlushMutex.Lock()
+	defer kvFlushMutex.Unlock()
+
+	kvQueueMutex.Lock()
+	batch := kvQueue
+	kvQueue = make(map[string][]byte, len(batch))
+	kvQueueMutex.Unlock()
+
+	var errs []error
+	for key, value := range batch {
+		var err error
+		if value == nil {
+			err = kv.Delete(key)
+		} else {
+			err = kv.Set(key, value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("'%s': %w", key, err))
+			kvQueueMutex.Lock()
+			if _, changed := kvQueue[key]; !changed {
+				kvQueue[key] = value
+			}
+			kvQueueMutex.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readKV calls fn for every key with the prefix, including the writes that are still
+// queued, so it sees what kv will have once everything is flushed
+func readKV(prefix string, fn func(key string, value []byte)) error {
+	// a flush in the middle would move writes from the queue to kv behind our back
+	kvFlushMutex.Lock()
+	defer kvFlushMutex.Unlock()
+
+	queued := make(map[string][]byte)
+	kvQueueMutex.Lock()
+	for key, value := range kvQueue {
+		if strings.HasPrefix(key, prefix) {
+			queued[key] = value
+		}
+	}
+	kvQueueMutex.Unlock()
+
+	err := kv.Iterate(prefix, func(key string, value []byte) {
+		if _, ok := queued[key]; !ok {
+			fn(key, value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range queued {
+		if value != nil {
+			fn(key, value)
+		}
+	}
+	return nil
+}
+
+// writeStores flushes the queued writes every second until ctx is done
+func writeStores(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := flushKV(); err != nil {
+				metricStoreWriteErrors.Inc()
+				log.Error().Err(err).Msg("failed to persist script stores")
+			}
+		}
+	}
+}
+
+// closeScriptStores writes whatever is still queued and closes kv
+func closeScriptStores() {
+	if err := flushKV(); err != nil {
+		metricStoreWriteErrors.Inc()
+		log.Error().Err(err).Msg("failed to persist script stores")
+	}
+	kv.Close()
+}
+
+type badgerKV struct {
+	Path string
+	db   *badger.DB
+}
+
+func (b *badgerKV) Init() (err error) {
+	b.db, err = badger.Open(badger.DefaultOptions(b.Path).WithLogger(nil))
+	return err
+}
+
+func (b *badgerKV) Close() { b.db.Close() }
+
+func (b *badgerKV) Iterate(prefix string, fn func(key string, value []byte)) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			fn(string(item.Key()), value)
+		}
+		return nil
+	})
+}
+
+func (b *badgerKV) Set(key string, value []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), value)
+	})
+}
+
+func (b *badgerKV) Delete(key string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+type lmdbKV struct {
+	Path string
+	env  *lmdb.Env
+	dbi  lmdb.DBI
+}
+
+func (b *lmdbKV) Init() error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	env.SetMaxDBs(1)
+	env.SetMapSize(1 << 32) // 4GB
+
+	if err := os.MkdirAll(b.Path, 0755); err != nil {
+		return err
+	}
+	if err := env.Open(b.Path, lmdb.NoTLS, 0644); err != nil {
+		return err
+	}
+	b.env = env
+
+	return b.env.Update(func(txn *lmdb.Txn) (err error) {
+		b.dbi, err = txn.OpenDBI("store", lmdb.Create)
+		return err
+	})
+}
+
+func (b *lmdbKV) Close() { b.env.Close() }
+
+func (b *lmdbKV) Iterate(prefix string, fn func(key string, value []byte)) error {
+	return b.env.View(func(txn *lmdb.Txn) error {
+		cursor, err := txn.OpenCursor(b.dbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		// lmdb doesn't take empty keys, so an empty prefix starts from the first key
+		k, v, err := cursor.Get(nil, nil, lmdb.First)
+		if prefix != "" {
+			k, v, err = cursor.Get([]byte(prefix), nil, lmdb.SetRange)
+		}
+		for {
+			if lmdb.IsNotFound(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(string(k), prefix) {
+				return nil
+			}
+			fn(string(k), v)
+			k, v, err = cursor.Get(nil, nil, lmdb.Next)
+		}
+	})
+}
+
+func (b *lmdbKV) Set(key string, value []byte) error {
+	return b.env.Update(func(txn *lmdb.Txn) error {
+		return txn.Put(b.dbi, []byte(key), value, 0)
+	})
+}
+
+func (b *lmdbKV) Delete(key string) error {
+	return b.env.Update(func(txn *lmdb.Txn) error {
+		if err := txn.Del(b.dbi, []byte(key), nil); err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+type sqliteKV struct {
+	Path string
+	db   *sql.DB
+}
+
+func (b *sqliteKV) Init() (err error) {
+	b.db, err = sql.Open("sqlite3", b.Path)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec(`CREATE TABLE IF NOT EXISTS store (key TEXT PRIMARY KEY, value BLOB NOT NULL)`)
+	return err
+}
+
+func (b *sqliteKV) Close() { b.db.Close() }
+
+func (b *sqliteKV) Iterate(prefix string, fn func(key string, value []byte)) error {
+	rows, err := b.db.Query(`SELECT key, value FROM store WHERE substr(key, 1, ?) = ?`,
+		utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		fn(key, value)
+	}
+	return rows.Err()
+}
+
+func (b *sqliteKV) Set(key string, value []byte) error {
+	_, err := b.db.Exec(`INSERT INTO store (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+func (b *sqliteKV) Delete(key string) error {
+	_, err := b.db.Exec(`DELETE FROM store WHERE key = ?`, key)
+	return err
+}
+
+type postgresKV struct {
+	DatabaseURL string
+	db          *sql.DB
+}
+
+func (b *postgresKV) Init() (err error) {
+	b.db, err = sql.Open("postgres", b.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec(`CREATE TABLE IF NOT EXISTS jingle_store (key text PRIMARY KEY, value bytea NOT NULL)`)
+	return err
+}
+
+func (b *postgresKV) Close() { b.db.Close() }
+
+func (b *postgresKV) Iterate(prefix string, fn func(key string, value []byte)) error {
+	rows, err := b.db.Query(`SELECT key, value FROM jingle_store WHERE substr(key, 1, $1) = $2`,
+		utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		fn(key, value)
+	}
+	return rows.Err()
+}
+
+func (b *postgresKV) Set(key string, value []byte) error {
+	_, err := b.db.Exec(`INSERT INTO jingle_store (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+func (b *postgresKV) Delete(key string) error {
+	_, err := b.db.Exec(`DELETE FROM jingle_store WHERE key = $1`, key)
+	return err
+}
+
+// memoryKV doesn't persist anything, the stores already keep everything in memory
+type memoryKV struct{}
+
+func (memoryKV) Init() error                                          { return nil }
+func (memoryKV) Close()                                               {}
+func (memoryKV) Iterate(string, func(key string, value []byte)) error { return nil }
+func (memoryKV) Set(string, []byte) error                             { return nil }
+func (memoryKV) Delete(string) error                                  { return nil }
+
+func makeKVBackend(backend string, path string) (kvBackend, error) {
+	switch backend {
+	case "sqlite", "sqlite3":
+		return &sqliteKV{Path: path}, nil
+	case "lmdb":
+		return &lmdbKV{Path: path}, nil
+	case "badger":
+		return &badgerKV{Path: path}, nil
+	case "postgres", "postgresql":
+		return &postgresKV{DatabaseURL: path}, nil
+	case "memory":
+		return memoryKV{}, nil
+	default:
+		return nil, fmt.Errorf("unknown option '%s' for database", backend)
+	}
+}
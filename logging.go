@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/fiatjaf/khatru"
+	"github.com/rs/zerolog"
+)
+
+// decisionLog gets one json line for each time a script decides something, if enabled
+var decisionLog *zerolog.Logger
+
+// setupLogging applies the log settings and makes logs go to out, it returns a function that
+// must be called on exit
+func setupLogging(out io.Writer) (func(), error) {
+	level, err := zerolog.ParseLevel(s.LogLevel)
+	if err != nil || level == zerolog.NoLevel {
+		return nil, fmt.Errorf("invalid log level '%s'", s.LogLevel)
+	}
+	zerolog.SetGlobalLevel(level)
+
+	switch s.LogFormat {
+	case "console":
+		log = log.Output(zerolog.ConsoleWriter{Out: out})
+	case "json":
+		log = log.Output(out)
+	default:
+		return nil, fmt.Errorf("invalid log format '%s', must be 'console' or 'json'", s.LogFormat)
+	}
+
+	switch s.DecisionLog {
+	case "":
+		return func() {}, nil
+	case "-":
+		dl := zerolog.New(os.Stdout).With().Timestamp().Logger()
+		decisionLog = &dl
+		return func() {}, nil
+	default:
+		file, err := os.OpenFile(s.DecisionLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open decision log: %w", err)
+		}
+		dl := zerolog.New(file).With().Timestamp().Logger()
+		decisionLog = &dl
+		return func() { file.Close() }, nil
+	}
+}
+
+// logDecision writes to the decision log and logs rejections at the info level.
+// describe adds the fields that identify what was being decided on (the event or the filter)
+func logDecision(
+	ctx context.Context,
+	script scriptPath,
+	version string,
+	start time.Time,
+	reject bool,
+	msg string,
+	describe func(e *zerolog.Event) *zerolog.Event,
+) {
+	if reject {
+		describe(log.Info()).Str("script", string(script)).Str("ip", getIP(ctx)).
+			Str("reason", msg).Msg("rejected")
+	}
+
+	if decisionLog == nil {
+		return
+	}
+	decision := "accept"
+	if reject {
+		decision = "reject"
+	}
+	e := decisionLog.Log().
+		Str("script", string(script)).
+		Str("version", version).
+		Str("ip", getIP(ctx))
+	if authed := khatru.GetAuthed(ctx); authed != "" {
+		e = e.Str("authed", authed)
+	}
+	describe(e).
+		Str("decision", decision).
+		Str("message", msg).
+		Dur("duration", time.Since(start)).
+		Send()
+}
+
+// scriptVersion identifies the contents of a script in the decision log
+func scriptVersion(source []byte) string {
+	hash := sha256.Sum256(source)
+	return hex.EncodeToString(hash[0:6])
+}
+
+var tengoLog = map[string]tengo.Object{
+	"debug": makeLogFunction("log.debug", zerolog.DebugLevel),
+	"info":  makeLogFunction("log.info", zerolog.InfoLevel),
+	"warn":  makeLogFunction("log.warn", zerolog.WarnLevel),
+	"error": makeLogFunction("log.error", zerolog.ErrorLevel),
+}
+
+func makeLogFunction(fname string, level zerolog.Level) *tengo.UserFunction {
+	return &tengo.UserFunction{
+		Name: fname,
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("%s() needs a message", fname)
+			}
+			msg, ok := tengo.ToString(args[0])
+			if !ok {
+				return nil, fmt.Errorf("%s() message must be a string", fname)
+			}
+
+			e := log.WithLevel(level).Str("from", "script")
+			if len(args) > 1 {
+				fields, err := tengoToMap(args[1])
+				if err != nil {
+					return nil, fmt.Errorf("%s() fields %w", fname, err)
+				}
+				for key, value := range fields {
+					// copying turns event objects into maps
+					e = e.Interface(key, tengo.ToInterface(value.Copy()))
+				}
+			}
+			e.Msg(msg)
+
+			return nil, nil
+		}),
+	}
+}
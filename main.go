@@ -7,16 +7,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fiatjaf/eventstore"
-	"github.com/fiatjaf/eventstore/badger"
-	"github.com/fiatjaf/eventstore/lmdb"
-	"github.com/fiatjaf/eventstore/sqlite3"
 	"github.com/fiatjaf/khatru"
 	"github.com/hoisie/mustache"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
 
@@ -26,14 +28,36 @@ import (
 type Settings struct {
 	Host             string `envconfig:"HOST" default:""`
 	Port             string `envconfig:"PORT" default:"5577"`
+	MetricsAddress   string `envconfig:"METRICS_ADDRESS" default:"127.0.0.1:5578"`
 	ServiceURL       string `envconfig:"SERVICE_URL"`
 	RelayName        string `envconfig:"RELAY_NAME" default:"jinglebells"`
 	RelayPubkey      string `envconfig:"RELAY_PUBKEY" default:"79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"`
 	RelayDescription string `envconfig:"RELAY_DESCRIPTION" default:"an experimental relay"`
+	RelaySecretKey   string `envconfig:"RELAY_SECRET_KEY"`
 	DatabaseBackend  string `envconfig:"DATABASE" default:"badger"`
 	DatabaseURL      string `envconfig:"DATABASE_URL"`
 	CustomDirectory  string `envconfig:"DATA_DIRECTORY" default:"stuff"`
 	DataDirectory    string `envconfig:"SCRIPTS_DIRECTORY" default:"data"`
+
+	StoreMemoryNamespaces   string `envconfig:"STORE_MEMORY_NAMESPACES"`
+	ScriptQueryDefaultLimit int    `envconfig:"SCRIPT_QUERY_DEFAULT_LIMIT" default:"100"`
+	ScriptQueryMaxLimit     int    `envconfig:"SCRIPT_QUERY_MAX_LIMIT" default:"500"`
+
+	HTTPAllowedHosts    string        `envconfig:"HTTP_ALLOWED_HOSTS"`
+	HTTPTimeout         time.Duration `envconfig:"HTTP_TIMEOUT" default:"10s"`
+	HTTPMaxResponseSize int64         `envconfig:"HTTP_MAX_RESPONSE_SIZE" default:"1048576"`
+	HTTPMaxConcurrent   int           `envconfig:"HTTP_MAX_CONCURRENT" default:"16"`
+	HTTPCacheTTL        time.Duration `envconfig:"HTTP_CACHE_TTL" default:"0s"`
+
+	LogLevel    string `envconfig:"LOG_LEVEL" default:"info"`
+	LogFormat   string `envconfig:"LOG_FORMAT" default:"console"`
+	DecisionLog string `envconfig:"DECISION_LOG"`
+
+	ExtraStores string `envconfig:"STORES"`
+	KindRoutes  string `envconfig:"ROUTES"`
+
+	Retention         string        `envconfig:"RETENTION"`
+	RetentionInterval time.Duration `envconfig:"RETENTION_INTERVAL" default:"1h"`
 }
 
 var (
@@ -75,9 +99,17 @@ func main() {
 				Destination: &s.Port,
 				Category:    CATEGORY_NETWORK,
 			},
+			&cli.StringFlag{
+				Name:        "metrics-address",
+				Usage:       "address in which to serve prometheus metrics at /metrics, separately from the relay so they aren't public (empty to disable them)",
+				Value:       s.MetricsAddress,
+				Destination: &s.MetricsAddress,
+				Category:    CATEGORY_NETWORK,
+			},
 			&cli.StringFlag{
 				Name:        "service-url",
 				Usage:       "base url of the relay, with http(s):// prefix",
+				Value:       s.ServiceURL,
 				Destination: &s.ServiceURL,
 				Category:    CATEGORY_NETWORK,
 			},
@@ -102,20 +134,58 @@ func main() {
 				Destination: &s.RelayPubkey,
 				Category:    CATEGORY_COMMON,
 			},
+			&cli.StringFlag{
+				Name:        "secret-key",
+				Usage:       "secret key (hex or nsec) of the relay itself, used by scripts to decrypt messages sent to the relay",
+				DefaultText: "none, or $RELAY_SECRET_KEY",
+				Value:       s.RelaySecretKey,
+				Destination: &s.RelaySecretKey,
+				Category:    CATEGORY_UNCOMMON,
+			},
 			&cli.StringFlag{
 				Name:        "db",
-				Usage:       "what database to use as a backend ('sqlite', 'lmdb' or 'badger')",
+				Usage:       "what database to use as a backend ('sqlite', 'lmdb', 'badger', 'postgres' or 'memory')",
 				Value:       s.DatabaseBackend,
 				Destination: &s.DatabaseBackend,
 				Category:    CATEGORY_COMMON,
 			},
 			&cli.StringFlag{
 				Name:        "database-uri",
-				Usage:       "path or custom URI that will be given to the database driver, prefixed with --datadir",
+				Usage:       "path or custom URI that will be given to the database driver, prefixed with --datadir (for postgres this is the connection string)",
 				DefaultText: "the name of the database driver",
+				Value:       s.DatabaseURL,
 				Destination: &s.DatabaseURL,
 				Category:    CATEGORY_UNCOMMON,
 			},
+			&cli.StringFlag{
+				Name:        "stores",
+				Usage:       "space-separated list of extra databases to route events to, like 'reactions=lmdb ephemeral=memory archive=postgres:<dsn>'",
+				Value:       s.ExtraStores,
+				Destination: &s.ExtraStores,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.StringFlag{
+				Name:        "routes",
+				Usage:       "space-separated list of kinds and the --stores they go to, like '7,9735=reactions 20000-29999=ephemeral', other kinds go to --db",
+				Value:       s.KindRoutes,
+				Destination: &s.KindRoutes,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.StringFlag{
+				Name:        "retention",
+				Usage:       "space-separated list of kinds and how many of their events to keep, like '1=age:30d 7,9735=count:500 *=size:1GB' (count is per pubkey, '*' is all kinds that aren't replaceable or addressable)",
+				DefaultText: "keep everything",
+				Value:       s.Retention,
+				Destination: &s.Retention,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.DurationFlag{
+				Name:        "retention-interval",
+				Usage:       "how often events are pruned according to --retention",
+				Value:       s.RetentionInterval,
+				Destination: &s.RetentionInterval,
+				Category:    CATEGORY_UNCOMMON,
+			},
 			&cli.StringFlag{
 				Name:        "datadir",
 				Usage:       "base directory for putting databases in",
@@ -130,9 +200,100 @@ func main() {
 				Destination: &s.CustomDirectory,
 				Category:    CATEGORY_UNCOMMON,
 			},
+			&cli.StringFlag{
+				Name:        "store-memory-only",
+				Usage:       "comma-separated list of relay.store namespaces (the part of the key before ':') that shouldn't be persisted",
+				Value:       s.StoreMemoryNamespaces,
+				Destination: &s.StoreMemoryNamespaces,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.IntFlag{
+				Name:        "script-query-limit",
+				Usage:       "limit applied to relay.query() calls from scripts when they don't specify one",
+				Value:       s.ScriptQueryDefaultLimit,
+				Destination: &s.ScriptQueryDefaultLimit,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.IntFlag{
+				Name:        "script-query-max-limit",
+				Usage:       "maximum limit for relay.query() calls from scripts",
+				Value:       s.ScriptQueryMaxLimit,
+				Destination: &s.ScriptQueryMaxLimit,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.StringFlag{
+				Name:        "http-allowed-hosts",
+				Usage:       "comma-separated list of hosts scripts can call with the http module ('*.example.com' matches subdomains)",
+				DefaultText: "any host",
+				Value:       s.HTTPAllowedHosts,
+				Destination: &s.HTTPAllowedHosts,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.DurationFlag{
+				Name:        "http-timeout",
+				Usage:       "maximum time an http call from a script can take",
+				Value:       s.HTTPTimeout,
+				Destination: &s.HTTPTimeout,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.Int64Flag{
+				Name:        "http-max-response-size",
+				Usage:       "maximum size in bytes of responses to http calls from scripts",
+				Value:       s.HTTPMaxResponseSize,
+				Destination: &s.HTTPMaxResponseSize,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.IntFlag{
+				Name:        "http-max-concurrent",
+				Usage:       "maximum number of http calls from scripts that can be running at the same time",
+				Value:       s.HTTPMaxConcurrent,
+				Destination: &s.HTTPMaxConcurrent,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.DurationFlag{
+				Name:        "http-cache-ttl",
+				Usage:       "for how long responses to http.get calls from scripts are cached, by url",
+				DefaultText: "no caching",
+				Value:       s.HTTPCacheTTL,
+				Destination: &s.HTTPCacheTTL,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Usage:       "minimum level of log messages ('debug', 'info', 'warn' or 'error'), rejections are logged at 'info'",
+				Value:       s.LogLevel,
+				Destination: &s.LogLevel,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				Usage:       "format of log messages ('console' or 'json')",
+				Value:       s.LogFormat,
+				Destination: &s.LogFormat,
+				Category:    CATEGORY_UNCOMMON,
+			},
+			&cli.StringFlag{
+				Name:        "decision-log",
+				Usage:       "file to append a json line to for every decision made by scripts ('-' for stdout)",
+				DefaultText: "disabled",
+				Value:       s.DecisionLog,
+				Destination: &s.DecisionLog,
+				Category:    CATEGORY_UNCOMMON,
+			},
 		},
 		ArgsUsage: "",
+		Commands: []*cli.Command{
+			exportCommand,
+			importCommand,
+			migrateCommand,
+		},
 		Action: func(c *cli.Context) error {
+			closeLogs, err := setupLogging(os.Stdout)
+			if err != nil {
+				return err
+			}
+			defer closeLogs()
+
 			// ensure this directory exists
 			os.MkdirAll(s.CustomDirectory, 0700)
 
@@ -156,9 +317,40 @@ func main() {
 				}
 			}
 
+			// relay identity
+			if s.RelaySecretKey != "" {
+				if strings.HasPrefix(s.RelaySecretKey, "nsec1") {
+					_, sk, err := nip19.Decode(s.RelaySecretKey)
+					if err != nil {
+						return fmt.Errorf("invalid relay secret key: %w", err)
+					}
+					s.RelaySecretKey = sk.(string)
+				}
+				pk, err := nostr.GetPublicKey(s.RelaySecretKey)
+				if err != nil {
+					return fmt.Errorf("invalid relay secret key: %w", err)
+				}
+				log.Info().Msgf("relay identity is %s", pk)
+			}
+
+			// how long events are kept
+			retentionRules, err = parseRetention(s.Retention)
+			if err != nil {
+				return err
+			}
+			if s.ScriptQueryDefaultLimit <= 0 || s.ScriptQueryMaxLimit <= 0 {
+				return fmt.Errorf("--script-query-limit and --script-query-max-limit must be positive")
+			}
+			if len(retentionRules) > 0 && s.RetentionInterval <= 0 {
+				return fmt.Errorf("--retention-interval must be positive")
+			}
+
 			// relay metadata
 			relay.Info.Name = s.RelayName
 			relay.Info.PubKey = s.RelayPubkey
+			if !hasOwner() {
+				log.Warn().Msg("the relay owner is not set with --pubkey, the /admin endpoints are disabled")
+			}
 			relay.Info.Description = s.RelayDescription
 			relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation,
 				func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
@@ -168,43 +360,19 @@ func main() {
 			)
 
 			// basic relay methods with custom stores
-			if err := os.MkdirAll(s.DataDirectory, 0700); err != nil {
-				return fmt.Errorf("failed to create datadir '%s': %w", s.DataDirectory, err)
-			}
-			var dbpath string
-			switch s.DatabaseBackend {
-			case "sqlite", "sqlite3":
-				uri := s.DatabaseURL
-				if uri == "" {
-					uri = "sqlite"
-				}
-				dbpath = filepath.Join(s.DataDirectory, uri)
-				db = &sqlite3.SQLite3Backend{DatabaseURL: dbpath}
-			case "lmdb":
-				uri := s.DatabaseURL
-				if uri == "" {
-					uri = "lmdb"
-				}
-				dbpath = filepath.Join(s.DataDirectory, uri)
-				db = &lmdb.LMDBBackend{Path: dbpath}
-			case "badger":
-				uri := s.DatabaseURL
-				if uri == "" {
-					uri = "badger"
-				}
-				dbpath = filepath.Join(s.DataDirectory, uri)
-				db = &badger.BadgerBackend{Path: dbpath}
-			default:
-				return fmt.Errorf("unknown option '%s' for database", s.DatabaseBackend)
-			}
-			if err := db.Init(); err != nil {
-				return fmt.Errorf("failed to initialize database: %w", err)
+			if err := openDatabase(); err != nil {
+				return err
 			}
 			defer db.Close()
-			log.Info().Msgf("storing data with %s under ./%s", s.DatabaseBackend, dbpath)
+
+			// persistent storage for scripts, using the same backend as the events
+			if err := openScriptStores(); err != nil {
+				return err
+			}
+			defer closeScriptStores()
 
 			relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
-			relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
+			relay.QueryEvents = append(relay.QueryEvents, clientQueryEvents(db, s.DatabaseBackend))
 			relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
 
 			// custom policies
@@ -214,10 +382,27 @@ func main() {
 			relay.RejectFilter = append(relay.RejectFilter,
 				rejectFilter,
 			)
+			relay.RejectCountFilter = append(relay.RejectCountFilter,
+				rejectKickedCount,
+			)
+			relay.OnConnect = append(relay.OnConnect,
+				onConnect,
+			)
 			relay.OnDisconnect = append(relay.OnDisconnect,
 				onDisconnect,
 			)
 
+			// keeping track of what each connection does
+			relay.OnEventSaved = append(relay.OnEventSaved,
+				onEventAccepted,
+			)
+			relay.OnEphemeralEvent = append(relay.OnEphemeralEvent,
+				onEventAccepted,
+			)
+			relay.OverwriteFilter = append(relay.OverwriteFilter,
+				onFilter,
+			)
+
 			// other http handlers
 			log.Info().Msgf("checking for html and assets under ./%s/", s.CustomDirectory)
 			homePath := filepath.Join(s.CustomDirectory, "index.html")
@@ -235,9 +420,14 @@ description:
 			}
 
 			mux := relay.Router()
+			mux.HandleFunc("/admin/store", handleAdminStore)
+			mux.HandleFunc("/admin/store/", handleAdminStore)
+			mux.HandleFunc("/admin/trace", handleAdminTrace)
+			mux.HandleFunc("/admin/trace/", handleAdminTrace)
 			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 				path := r.URL.Path[1:]
-				if path == string(REJECT_EVENT) || path == string(REJECT_FILTER) {
+				if path == string(REJECT_EVENT) || path == string(REJECT_FILTER) || path == string(ROUTE_EVENT) ||
+					path == string(RETENTION) {
 					w.WriteHeader(403)
 					return
 				}
@@ -262,11 +452,46 @@ description:
 				localhost = "0.0.0.0"
 			}
 			log.Info().Msg("running on http://" + localhost + ":" + s.Port)
-			server := &http.Server{Addr: ":" + s.Port, Handler: relay}
+			server := &http.Server{Addr: ":" + s.Port, Handler: withRawConnections(withRetentionInfo(relay))}
 			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer cancel()
 			g, ctx := errgroup.WithContext(ctx)
 			g.Go(server.ListenAndServe)
+			if s.MetricsAddress != "" {
+				log.Info().Msg("serving metrics on http://" + s.MetricsAddress + "/metrics")
+				metricsMux := http.NewServeMux()
+				metricsMux.Handle("/metrics", promhttp.Handler())
+				metricsServer := &http.Server{Addr: s.MetricsAddress, Handler: metricsMux}
+				g.Go(metricsServer.ListenAndServe)
+				g.Go(func() error {
+					<-ctx.Done()
+					return metricsServer.Shutdown(context.Background())
+				})
+			}
+			g.Go(func() error {
+				sweepHttpCache(ctx)
+				return nil
+			})
+			g.Go(func() error {
+				sweepStores(ctx)
+				return nil
+			})
+			g.Go(func() error {
+				writeStores(ctx)
+				return nil
+			})
+			g.Go(func() error {
+				sweepRetention(ctx)
+				return nil
+			})
+			g.Go(func() error {
+				sweepBuckets(ctx)
+				return nil
+			})
+			g.Go(func() error {
+				sweepTracers(ctx)
+				return nil
+			})
 			g.Go(func() error {
 				<-ctx.Done()
 				return server.Shutdown(context.Background())
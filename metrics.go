@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricEventsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jingle_events_accepted_total",
+		Help: "Events stored or broadcasted (ephemeral) after passing reject-event.tengo.",
+	})
+	metricEventsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jingle_events_rejected_total",
+		Help: "Events rejected by reject-event.tengo, by the prefix of the message.",
+	}, []string{"reason"})
+	metricEventsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jingle_events_pruned_total",
+		Help: "Events deleted by the retention rules, by the limit they were over.",
+	}, []string{"reason"})
+	metricReqs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jingle_reqs_total",
+		Help: "REQ messages received.",
+	})
+	metricReqsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jingle_reqs_rejected_total",
+		Help: "REQ messages rejected by reject-filter.tengo, by the prefix of the message.",
+	}, []string{"reason"})
+
+	metricScriptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jingle_script_duration_seconds",
+		Help:    "Time spent running each script.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"script"})
+	metricScriptErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jingle_script_errors_total",
+		Help: "Scripts that failed to compile or to run.",
+	}, []string{"script", "stage"})
+
+	metricStoreWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jingle_store_write_errors_total",
+		Help: "Times script stores failed to be written to the database.",
+	})
+
+	metricHttpCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jingle_script_http_calls_total",
+		Help: "Calls to the http module from scripts, by function and result.",
+	}, []string{"function", "result"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jingle_connections",
+		Help: "Open websocket connections.",
+	}, func() float64 {
+		return float64(connections.Size())
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "jingle_subscriptions",
+		Help: "Subscriptions opened on the open connections.",
+	}, func() float64 {
+		total := 0
+		connections.Range(func(_ *khatru.WebSocket, stats *connectionStats) bool {
+			total += stats.subscriptions.Size()
+			return true
+		})
+		return float64(total)
+	})
+
+	for name, size := range map[string]func() int{
+		"relay": globalStore.size,
+		"user": func() int {
+			total := 0
+			userStores.Range(func(_ string, st *store) bool {
+				total += st.size()
+				return true
+			})
+			return total
+		},
+		"connection": func() int {
+			total := 0
+			sessionStorage.Range(func(_ *khatru.WebSocket, st *store) bool {
+				total += st.size()
+				return true
+			})
+			return total
+		},
+	} {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "jingle_store_keys",
+			Help:        "Keys in the script stores.",
+			ConstLabels: prometheus.Labels{"store": name},
+		}, func() float64 {
+			return float64(size())
+		})
+	}
+}
+
+// reasonPrefix gets the machine-readable prefix of a rejection message in the same way
+// khatru does when sending it, anything other than the standard ones is "other" so
+// scripts can't blow up the number of metrics
+func reasonPrefix(msg string) string {
+	prefix, _, _ := strings.Cut(nostr.NormalizeOKMessage(msg, "blocked"), ": ")
+	switch prefix {
+	case "duplicate", "pow", "blocked", "rate-limited", "invalid", "error", "auth-required", "restricted":
+		return prefix
+	default:
+		return "other"
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/parser"
 	"github.com/d5/tengo/v2/stdlib"
+	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
 )
 
 type scriptPath string
@@ -21,9 +26,14 @@ const (
 var (
 	rejectEventCompiled    *tengo.Compiled
 	lastRejectEventModtime time.Time
+	rejectEventVersion     string
+	rejectEventMutex       sync.Mutex
 
 	rejectFilterCompiled    *tengo.Compiled
 	lastRejectFilterModtime time.Time
+	rejectFilterTakesReq    bool
+	rejectFilterVersion     string
+	rejectFilterMutex       sync.Mutex
 )
 
 var defaultScripts = map[scriptPath]string{
@@ -71,14 +81,126 @@ export func(filter, relay, conn) {
 }`,
 }
 
+// makeModules returns the modules that can be imported by any script: the tengo stdlib, the
+// modules we ship ourselves and the user script itself, under "userscript"
+func makeModules(source []byte) *tengo.ModuleMap {
+	modules := tengo.NewModuleMap()
+	for name, mod := range stdlib.SourceModules {
+		modules.AddSourceModule(name, []byte(mod))
+	}
+	for name, mod := range stdlib.BuiltinModules {
+		modules.AddBuiltinModule(name, mod)
+	}
+	modules.AddBuiltinModule("json", tengoJSON)
+	modules.AddBuiltinModule("http", tengoHttp)
+	modules.AddBuiltinModule("nostr", tengoNostr)
+	modules.AddBuiltinModule("crypto", tengoCrypto)
+	modules.AddBuiltinModule("ratelimit", tengoRatelimit)
+	modules.AddBuiltinModule("log", tengoLog)
+	modules.AddSourceModule("userscript", source)
+	return modules
+}
+
+// scriptParameters returns how many parameters the function exported by a script takes
+// (variadic functions can take any number), or 0 if it doesn't export a function. the
+// script is only compiled, so its top-level code doesn't run
+func scriptParameters(source []byte) int {
+	main := []byte(`import("userscript")`)
+	fileSet := parser.NewFileSet()
+	file := fileSet.AddFile("(main)", -1, len(main))
+	parsed, err := parser.NewParser(file, main, nil).ParseFile()
+	if err != nil {
+		return 0
+	}
+	symbolTable := tengo.NewSymbolTable()
+	for idx, fn := range tengo.GetAllBuiltinFunctions() {
+		symbolTable.DefineBuiltin(idx, fn.Name)
+	}
+	compiler := tengo.NewCompiler(file, symbolTable, nil, makeModules(source), nil)
+	if err := compiler.Compile(parsed); err != nil {
+		return 0
+	}
+	bytecode := compiler.Bytecode()
+
+	// the main function only loads the module, which is the first constant it uses
+	module := pushedFunction(bytecode.MainFunction, bytecode.Constants, false)
+	if module == nil {
+		return 0
+	}
+	fn := pushedFunction(module, bytecode.Constants, true)
+	if fn == nil {
+		return 0
+	}
+	if fn.VarArgs {
+		return math.MaxInt
+	}
+	return fn.NumParameters
+}
+
+// pushedFunction goes through the instructions of fn looking for a compiled function: the
+// first one it loads or, with exported, the one it returns. only function literals and
+// local variables set to them are followed, which is how modules export functions
+func pushedFunction(fn *tengo.CompiledFunction, constants []tengo.Object, exported bool) *tengo.CompiledFunction {
+	locals := make(map[int]*tengo.CompiledFunction)
+	var last *tengo.CompiledFunction // the function the previous instruction left on the stack
+	for i := 0; i < len(fn.Instructions); {
+		op := fn.Instructions[i]
+		operands, read := parser.ReadOperands(parser.OpcodeOperands[op], fn.Instructions[i+1:])
+		i += 1 + read
+
+		var pushed *tengo.CompiledFunction
+		switch op {
+		case parser.OpConstant, parser.OpClosure:
+			pushed, _ = constants[operands[0]].(*tengo.CompiledFunction)
+			if !exported && pushed != nil {
+				return pushed
+			}
+		case parser.OpGetLocal:
+			pushed = locals[operands[0]]
+		case parser.OpDefineLocal, parser.OpSetLocal:
+			locals[operands[0]] = last
+		case parser.OpImmutable:
+			// export makes what it returns immutable, functions stay the same
+			pushed = last
+		case parser.OpReturn:
+			if exported && operands[0] == 1 {
+				return last
+			}
+		}
+		last = pushed
+	}
+	return nil
+}
+
 func rejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	start := time.Now()
+	ctx, trace := traceFor(ctx, REJECT_EVENT, event, nil)
+	defer func() {
+		if trace != nil {
+			trace.finish(start, reject, msg)
+		}
+		if reject {
+			metricEventsRejected.WithLabelValues(reasonPrefix(msg)).Inc()
+		}
+		rejectEventMutex.Lock()
+		version := rejectEventVersion
+		rejectEventMutex.Unlock()
+		logDecision(ctx, REJECT_EVENT, version, start, reject, msg, func(e *zerolog.Event) *zerolog.Event {
+			return e.Str("id", event.ID).Int("kind", event.Kind).Str("pubkey", event.PubKey)
+		})
+	}()
+
+	if isKicked(ctx) {
+		return true, "blocked: this connection was closed"
+	}
+
 	fpath := filepath.Join(s.CustomDirectory, string(REJECT_EVENT))
 	fstat, err := os.Stat(fpath)
 	if err != nil {
 		return true, "couldn't find script file"
 	}
 
-	var this *tengo.Compiled
+	rejectEventMutex.Lock()
 	if fstat.ModTime().After(lastRejectEventModtime) {
 		lastRejectEventModtime = fstat.ModTime()
 		script := tengo.NewScript([]byte(`
@@ -86,35 +208,40 @@ reject := import("userscript")
 res := reject(event, relay, conn)
 `))
 
-		modules := tengo.NewModuleMap()
-		for name, mod := range stdlib.SourceModules {
-			modules.AddSourceModule(name, []byte(mod))
-		}
-		for name, mod := range stdlib.BuiltinModules {
-			modules.AddBuiltinModule(name, mod)
-		}
 		source, _ := os.ReadFile(fpath)
-		modules.AddSourceModule("userscript", source)
-
-		script.SetImports(modules)
+		script.SetImports(makeModules(source))
 		script.Add("event", nil)
 		script.Add("relay", nil)
 		script.Add("conn", nil)
 
+		rejectEventVersion = scriptVersion(source)
 		rejectEventCompiled, err = script.Compile()
 		if err != nil {
+			rejectEventMutex.Unlock()
+			metricScriptErrors.WithLabelValues(string(REJECT_EVENT), "compile").Inc()
 			return true, "script is invalid: " + err.Error()
 		}
-
-		this = rejectEventCompiled.Clone()
-	} else {
-		this = rejectEventCompiled.Clone()
 	}
+	compiled := rejectEventCompiled
+	rejectEventMutex.Unlock()
+	if compiled == nil {
+		return true, "script is invalid"
+	}
+
+	this := compiled.Clone()
 
 	this.Set("event", eventToTengo(event))
+	// this will stop all queries the script didn't consume entirely once it is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	this.Set("relay", makeRelayObject(ctx))
 	this.Set("conn", makeConnectionObject(ctx))
-	if err := this.RunContext(ctx); err != nil {
+	runStart := time.Now()
+	err = this.RunContext(ctx)
+	metricScriptDuration.WithLabelValues(string(REJECT_EVENT)).Observe(time.Since(runStart).Seconds())
+	if err != nil {
+		metricScriptErrors.WithLabelValues(string(REJECT_EVENT), "run").Inc()
 		return true, "script failed to run: " + err.Error()
 	}
 
@@ -122,55 +249,94 @@ res := reject(event, relay, conn)
 	if res.String() == "" {
 		return false, ""
 	} else {
+		if stats := getConnectionStats(ctx); stats != nil {
+			stats.rejected.Add(1)
+		}
 		return true, res.String()
 	}
 }
 
 func rejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	start := time.Now()
+	ctx, trace := traceFor(ctx, REJECT_FILTER, nil, &filter)
+	defer func() {
+		if trace != nil {
+			trace.finish(start, reject, msg)
+		}
+		if reject {
+			metricReqsRejected.WithLabelValues(reasonPrefix(msg)).Inc()
+		}
+		rejectFilterMutex.Lock()
+		version := rejectFilterVersion
+		rejectFilterMutex.Unlock()
+		logDecision(ctx, REJECT_FILTER, version, start, reject, msg, func(e *zerolog.Event) *zerolog.Event {
+			return e.Str("subscription", khatru.GetSubscriptionID(ctx)).RawJSON("filter", []byte(filter.String()))
+		})
+	}()
+
+	if isKicked(ctx) {
+		return true, "blocked: this connection was closed"
+	}
+
 	fpath := filepath.Join(s.CustomDirectory, string(REJECT_FILTER))
 	fstat, err := os.Stat(fpath)
 	if err != nil {
 		return true, "couldn't find script file"
 	}
 
-	var this *tengo.Compiled
+	rejectFilterMutex.Lock()
 	if fstat.ModTime().After(lastRejectFilterModtime) {
 		lastRejectFilterModtime = fstat.ModTime()
-		script := tengo.NewScript([]byte(`
-reject := import("userscript")
-res := reject(filter, relay, conn)
-`))
+		source, _ := os.ReadFile(fpath)
 
-		modules := tengo.NewModuleMap()
-		for name, mod := range stdlib.SourceModules {
-			modules.AddSourceModule(name, []byte(mod))
+		// the REQ details are only given to scripts that have a 4th parameter for them
+		call := `res := reject(filter, relay, conn)`
+		rejectFilterTakesReq = scriptParameters(source) >= 4
+		if rejectFilterTakesReq {
+			call = `res := reject(filter, relay, conn, req)`
 		}
-		for name, mod := range stdlib.BuiltinModules {
-			modules.AddBuiltinModule(name, mod)
-		}
-		source, _ := os.ReadFile(fpath)
-		modules.AddSourceModule("userscript", source)
-		modules.AddBuiltinModule("http", tengoHttp)
+		script := tengo.NewScript([]byte(`
+reject := import("userscript")
+` + call))
 
-		script.SetImports(modules)
+		script.SetImports(makeModules(source))
 		script.Add("filter", nil)
 		script.Add("relay", nil)
 		script.Add("conn", nil)
+		script.Add("req", nil)
 
+		rejectFilterVersion = scriptVersion(source)
 		rejectFilterCompiled, err = script.Compile()
 		if err != nil {
+			rejectFilterMutex.Unlock()
+			metricScriptErrors.WithLabelValues(string(REJECT_FILTER), "compile").Inc()
 			return true, "script is invalid: " + err.Error()
 		}
-
-		this = rejectFilterCompiled.Clone()
-	} else {
-		this = rejectFilterCompiled.Clone()
 	}
+	compiled := rejectFilterCompiled
+	takesReq := rejectFilterTakesReq
+	rejectFilterMutex.Unlock()
+	if compiled == nil {
+		return true, "script is invalid"
+	}
+
+	this := compiled.Clone()
 
 	this.Set("filter", filterToTengo(filter))
+	// this will stop all queries the script didn't consume entirely once it is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	this.Set("relay", makeRelayObject(ctx))
 	this.Set("conn", makeConnectionObject(ctx))
-	if err := this.RunContext(ctx); err != nil {
+	if takesReq {
+		this.Set("req", makeReqObject(ctx))
+	}
+	runStart := time.Now()
+	err = this.RunContext(ctx)
+	metricScriptDuration.WithLabelValues(string(REJECT_FILTER)).Observe(time.Since(runStart).Seconds())
+	if err != nil {
+		metricScriptErrors.WithLabelValues(string(REJECT_FILTER), "run").Inc()
 		return true, "script failed to run: " + err.Error()
 	}
 
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScriptParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		source string
+		params int
+	}{
+		{"three", `export func(event, relay, conn) {}`, 3},
+		{"four", `export func(filter, relay, conn, req) { return undefined }`, 4},
+		{"variadic", `export func(event, ...rest) {}`, math.MaxInt},
+		{"variable", "f := func(event, reason) { return true }\nexport f", 2},
+		{"with helpers", "helper := func(x) { return x }\nexport func(a, b, c, d) { return helper(a) }", 4},
+		{"closure", "n := 1\nexport func(event) { return n }", 1},
+		{"with imports", "text := import(\"text\")\nexport func(a, b) { return text.trim_space(a) }", 2},
+		{"top-level code doesn't run", "for {}\nexport func(event) {}", 1},
+		{"not a function", `export {a: 1}`, 0},
+		{"no export", `x := 1`, 0},
+		{"invalid", `export func(`, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if params := scriptParameters([]byte(tc.source)); params != tc.params {
+				t.Fatalf("expected %d parameters, got %d", tc.params, params)
+			}
+		})
+	}
+}
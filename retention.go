@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const RETENTION scriptPath = "retention.tengo"
+
+// retentionRule limits how many events of some kinds are kept, the sweeper prunes the
+// events that are over any of the limits
+type retentionRule struct {
+	kinds    []kindRange // nil means all kinds, except replaceable and addressable ones
+	maxAge   time.Duration
+	maxCount int   // per pubkey
+	maxSize  int64 // in bytes, of all the events together
+}
+
+var retentionRules []retentionRule
+
+// parseRetention parses the --retention setting, which is like
+// "<kinds>=age:<duration>,count:<n>,size:<bytes> ...", where kinds can be "*" for all kinds
+// that aren't replaceable or addressable, as pruning profiles and contact lists is rarely wanted
+func parseRetention(rules string) ([]retentionRule, error) {
+	parsed := make([]retentionRule, 0, 2)
+	for _, def := range strings.Fields(rules) {
+		kinds, limits, ok := strings.Cut(def, "=")
+		if !ok || limits == "" {
+			return nil, fmt.Errorf("invalid retention rule '%s', must be like 'kind,kind=age:30d,count:100,size:1GB'", def)
+		}
+
+		rule := retentionRule{}
+		if kinds != "*" {
+			ranges, err := parseKindRanges(kinds)
+			if err != nil {
+				return nil, fmt.Errorf("%w in retention rule '%s'", err, def)
+			}
+			rule.kinds = ranges
+		}
+
+		for _, limit := range strings.Split(limits, ",") {
+			name, value, _ := strings.Cut(limit, ":")
+			var err error
+			switch name {
+			case "age":
+				rule.maxAge, err = parseAge(value)
+			case "count":
+				rule.maxCount, err = strconv.Atoi(value)
+				if err == nil && rule.maxCount <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			case "size":
+				rule.maxSize, err = parseSize(value)
+			default:
+				err = fmt.Errorf("must be 'age', 'count' or 'size'")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit '%s' in retention rule '%s': %w", limit, def, err)
+			}
+		}
+
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// parseAge is like time.ParseDuration but also takes days, like "30d"
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// parseSize takes a number of bytes with an optional B, KB, MB or GB suffix, like "1.5GB"
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(value)
+	multiplier := float64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value = n
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	size := n * multiplier
+	if err != nil || !(size >= 1 && size < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid size")
+	}
+	return int64(size), nil
+}
+
+// filter matches the events this rule applies to, or more if there are too many kinds to
+// list, so matches() must also be checked
+func (rule retentionRule) filter() nostr.Filter {
+	filter := nostr.Filter{}
+	total := 0
+	for _, kr := range rule.kinds {
+		total += kr.to - kr.from + 1
+	}
+	if rule.kinds != nil && total <= 100 {
+		filter.Kinds = make([]int, 0, total)
+		for _, kr := range rule.kinds {
+			for kind := kr.from; kind <= kr.to; kind++ {
+				filter.Kinds = append(filter.Kinds, kind)
+			}
+		}
+	}
+	if rule.maxCount == 0 && rule.maxSize == 0 {
+		// only old events can be pruned
+		until := nostr.Timestamp(time.Now().Add(-rule.maxAge).Unix())
+		filter.Until = &until
+	}
+	return filter
+}
+
+func (rule retentionRule) matches(evt *nostr.Event) bool {
+	if rule.kinds == nil {
+		return !evt.IsReplaceable() && !evt.IsAddressable()
+	}
+	for _, kr := range rule.kinds {
+		if kr.contains(evt.Kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepRetention prunes events according to the retention rules every --retention-interval
+func sweepRetention(ctx context.Context) {
+	if len(retentionRules) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		pruned, err := applyRetention(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msg("failed to apply retention rules")
+		}
+		if pruned > 0 {
+			log.Info().Msgf("pruned %d events", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyRetention goes through the events each rule applies to, newest first, and deletes
+// the ones over its limits that retention.tengo doesn't want to keep
+func applyRetention(ctx context.Context) (int, error) {
+	pruned := 0
+	for _, rule := range retentionRules {
+		cutoff := nostr.Timestamp(time.Now().Add(-rule.maxAge).Unix())
+		counts := make(map[string]int)
+		var size int64
+
+		err := iterateEvents(ctx, db, rule.filter(), func(evt *nostr.Event) error {
+			if !rule.matches(evt) {
+				return nil
+			}
+
+			counts[evt.PubKey]++
+			size += int64(len(evt.String()))
+
+			reason := ""
+			if rule.maxAge > 0 && evt.CreatedAt < cutoff {
+				reason = "age"
+			} else if rule.maxCount > 0 && counts[evt.PubKey] > rule.maxCount {
+				reason = "count"
+			} else if rule.maxSize > 0 && size > rule.maxSize {
+				reason = "size"
+			}
+			if reason == "" || !shouldPrune(ctx, evt, reason) {
+				return nil
+			}
+
+			if err := db.DeleteEvent(ctx, evt); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", evt.ID, err)
+			}
+			metricEventsPruned.WithLabelValues(reason).Inc()
+			pruned++
+			return nil
+		})
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+var (
+	retentionCompiled    *tengo.Compiled
+	lastRetentionModtime time.Time
+	retentionMutex       sync.Mutex
+)
+
+// shouldPrune calls retention.tengo, if it exists, with an event that is over the limits and
+// the limit that it is over. the event is kept if the script returns false
+func shouldPrune(ctx context.Context, event *nostr.Event, reason string) bool {
+	fpath := filepath.Join(s.CustomDirectory, string(RETENTION))
+	fstat, err := os.Stat(fpath)
+	if err != nil {
+		return true
+	}
+
+	retentionMutex.Lock()
+	if fstat.ModTime().After(lastRetentionModtime) {
+		lastRetentionModtime = fstat.ModTime()
+		source, _ := os.ReadFile(fpath)
+
+		// the script can take only the arguments it needs
+		args := []string{"event", "reason", "relay"}
+		args = args[0:min(len(args), scriptParameters(source))]
+		script := tengo.NewScript([]byte(`
+prune := import("userscript")
+res := prune(` + strings.Join(args, ", ") + `)
+`))
+		script.SetImports(makeModules(source))
+		for _, arg := range args {
+			script.Add(arg, nil)
+		}
+
+		retentionCompiled, err = script.Compile()
+		if err != nil {
+			metricScriptErrors.WithLabelValues(string(RETENTION), "compile").Inc()
+			log.Warn().Err(err).Msg("retention.tengo is invalid")
+		}
+	}
+	compiled := retentionCompiled
+	retentionMutex.Unlock()
+	if compiled == nil {
+		// better not to delete anything while the script is broken
+		return false
+	}
+
+	start := time.Now()
+	ctx, trace := traceFor(ctx, RETENTION, event, nil)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	this := compiled.Clone()
+	this.Set("event", eventToTengo(event))
+	this.Set("reason", reason)
+	this.Set("relay", makeRelayObject(ctx))
+	err = this.RunContext(ctx)
+	metricScriptDuration.WithLabelValues(string(RETENTION)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricScriptErrors.WithLabelValues(string(RETENTION), "run").Inc()
+		log.Warn().Err(err).Str("id", event.ID).Msg("retention.tengo failed to run")
+		if trace != nil {
+			trace.finishWith(start, "keep", "script failed to run: "+err.Error())
+		}
+		return false
+	}
+
+	keep, isBool := this.Get("res").Object().(*tengo.Bool)
+	prune := !isBool || !keep.IsFalsy()
+	if trace != nil {
+		decision := "keep"
+		if prune {
+			decision = "prune"
+		}
+		trace.finishWith(start, decision, reason)
+	}
+	return prune
+}
+
+// retentionInfo describes the rules in the NIP-11 format, where there is no size limit and
+// the count is of all events, not per pubkey, so only the ages are there
+func retentionInfo() []map[string]any {
+	info := make([]map[string]any, 0, len(retentionRules))
+	for _, rule := range retentionRules {
+		if rule.maxAge == 0 {
+			continue
+		}
+		entry := make(map[string]any, 2)
+		if rule.kinds != nil {
+			kinds := make([]any, len(rule.kinds))
+			for i, kr := range rule.kinds {
+				if kr.from == kr.to {
+					kinds[i] = kr.from
+				} else {
+					kinds[i] = []int{kr.from, kr.to}
+				}
+			}
+			entry["kinds"] = kinds
+		}
+		entry["time"] = int64(rule.maxAge.Seconds())
+		info = append(info, entry)
+	}
+	return info
+}
+
+// withRetentionInfo adds the retention field to the NIP-11 document, which go-nostr doesn't have
+func withRetentionInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(retentionRules) == 0 ||
+			r.Header.Get("Upgrade") == "websocket" || r.Header.Get("Accept") != "application/nostr+json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+		info := make(map[string]stdjson.RawMessage)
+		if rec.Code != 200 || stdjson.Unmarshal(rec.Body.Bytes(), &info) != nil {
+			// not what we expected, pass it along untouched
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+			return
+		}
+
+		info["retention"], _ = stdjson.Marshal(retentionInfo())
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		stdjson.NewEncoder(w).Encode(info)
+	})
+}
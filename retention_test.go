@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseRetention(t *testing.T) {
+	for _, tc := range []struct {
+		rules  string
+		parsed []retentionRule
+		err    string
+	}{
+		{"", []retentionRule{}, ""},
+		{"1=age:30d", []retentionRule{{kinds: []kindRange{{1, 1}}, maxAge: 30 * 24 * time.Hour}}, ""},
+		{
+			"7,9735=age:12h,count:100 *=size:1.5KB",
+			[]retentionRule{
+				{kinds: []kindRange{{7, 7}, {9735, 9735}}, maxAge: 12 * time.Hour, maxCount: 100},
+				{maxSize: 1536},
+			},
+			"",
+		},
+		{"20000-29999=size:10b", []retentionRule{{kinds: []kindRange{{20000, 29999}}, maxSize: 10}}, ""},
+		{"1=size:2gb,size:3MB", []retentionRule{{kinds: []kindRange{{1, 1}}, maxSize: 3 << 20}}, ""},
+		{"1", nil, "invalid retention rule '1'"},
+		{"1=", nil, "invalid retention rule '1='"},
+		{"x=age:1d", nil, "invalid kinds 'x'"},
+		{"1=age:0d", nil, "invalid number of days"},
+		{"1=age:-1h", nil, "must be positive"},
+		{"1=age:1y", nil, "invalid limit 'age:1y'"},
+		{"1=count:0", nil, "must be positive"},
+		{"1=count:many", nil, "invalid limit 'count:many'"},
+		{"1=size:0.1B", nil, "invalid size"},
+		{"1=size:B", nil, "invalid size"},
+		{"1=size:-1KB", nil, "invalid size"},
+		{"1=size:inf", nil, "invalid size"},
+		{"1=weight:1", nil, "must be 'age', 'count' or 'size'"},
+	} {
+		t.Run(tc.rules, func(t *testing.T) {
+			parsed, err := parseRetention(tc.rules)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with '%s', got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(parsed, tc.parsed) {
+				t.Fatalf("expected %v, got %v", tc.parsed, parsed)
+			}
+		})
+	}
+}
+
+func TestRetentionRuleMatches(t *testing.T) {
+	all := retentionRule{}
+	some := retentionRule{kinds: []kindRange{{0, 1}, {30000, 39999}}}
+
+	for _, tc := range []struct {
+		kind      int
+		all, some bool
+	}{
+		{0, false, true},
+		{1, true, true},
+		{3, false, false},
+		{7, true, false},
+		{10002, false, false},
+		{20001, true, false},
+		{30023, false, true},
+		{40000, true, false},
+	} {
+		evt := &nostr.Event{Kind: tc.kind}
+		if all.matches(evt) != tc.all {
+			t.Errorf("expected '*' matching kind %d to be %v", tc.kind, tc.all)
+		}
+		if some.matches(evt) != tc.some {
+			t.Errorf("expected '0-1,30000-39999' matching kind %d to be %v", tc.kind, tc.some)
+		}
+	}
+}
+
+func TestRetentionInfo(t *testing.T) {
+	defer func() { retentionRules = nil }()
+
+	retentionRules, _ = parseRetention("1=age:1h,count:10 7=count:5 9735,20000-29999=age:30d,size:1GB *=size:1GB")
+	expected := []map[string]any{
+		{"kinds": []any{1}, "time": int64(3600)},
+		{"kinds": []any{9735, []int{20000, 29999}}, "time": int64(30 * 24 * 3600)},
+	}
+	if info := retentionInfo(); !reflect.DeepEqual(info, expected) {
+		t.Fatalf("expected %v, got %v", expected, info)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const ROUTE_EVENT scriptPath = "route-event.tengo"
+
+// router is used as the eventstore when there are extra stores configured, it saves each
+// event in the store its kind (or route-event.tengo) says and fans queries out to all
+// the stores that may have matching events
+type router struct {
+	main   eventstore.Store
+	stores map[string]eventstore.Store
+	routes []kindRoute
+}
+
+type kindRoute struct {
+	kindRange
+	store string
+}
+
+// kindRange includes from and to
+type kindRange struct {
+	from, to int
+}
+
+func (kr kindRange) contains(kind int) bool {
+	return kind >= kr.from && kind <= kr.to
+}
+
+// parseKindRanges parses a comma-separated list of kinds and ranges of kinds like "1,7,20000-29999"
+func parseKindRanges(kinds string) ([]kindRange, error) {
+	ranges := make([]kindRange, 0, 2)
+	for _, k := range strings.Split(kinds, ",") {
+		fromS, toS, isRange := strings.Cut(k, "-")
+		if !isRange {
+			toS = fromS
+		}
+		from, err1 := strconv.Atoi(fromS)
+		to, err2 := strconv.Atoi(toS)
+		if err1 != nil || err2 != nil || to < from {
+			return nil, fmt.Errorf("invalid kinds '%s'", k)
+		}
+		ranges = append(ranges, kindRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+var _ eventstore.Store = (*router)(nil)
+
+// makeRouter parses the --stores and --routes settings, stores are like
+// "<name>=<backend>[:<uri>]" and routes are like "<kind>,<kind>,<from>-<to>=<name>"
+func makeRouter(main eventstore.Store, stores string, routes string) (*router, error) {
+	r := &router{
+		main:   main,
+		stores: make(map[string]eventstore.Store),
+		routes: make([]kindRoute, 0),
+	}
+
+	for _, def := range strings.Fields(stores) {
+		name, spec, ok := strings.Cut(def, "=")
+		if !ok || name == "" || name == "main" {
+			return nil, fmt.Errorf("invalid store '%s', must be like 'name=backend:uri'", def)
+		}
+		if _, exists := r.stores[name]; exists {
+			return nil, fmt.Errorf("store '%s' is defined twice", name)
+		}
+		backend, uri, _ := strings.Cut(spec, ":")
+		if uri == "" {
+			// so stores with the same backend don't end up in the same place
+			uri = name
+		}
+		es, location, err := makeEventStore(backend, uri)
+		if err != nil {
+			return nil, fmt.Errorf("store '%s': %w", name, err)
+		}
+		r.stores[name] = es
+		log.Info().Msgf("store '%s' is %s in %s", name, backend, location)
+	}
+
+	for _, def := range strings.Fields(routes) {
+		kinds, name, ok := strings.Cut(def, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route '%s', must be like 'kind,kind,from-to=name'", def)
+		}
+		if _, exists := r.stores[name]; !exists && name != "main" {
+			return nil, fmt.Errorf("route '%s' goes to unknown store '%s'", def, name)
+		}
+		ranges, err := parseKindRanges(kinds)
+		if err != nil {
+			return nil, fmt.Errorf("%w in route '%s'", err, def)
+		}
+		for _, kr := range ranges {
+			r.routes = append(r.routes, kindRoute{kindRange: kr, store: name})
+		}
+	}
+
+	return r, nil
+}
+
+func (r *router) Init() error {
+	if err := r.main.Init(); err != nil {
+		return err
+	}
+	for name, store := range r.stores {
+		if err := store.Init(); err != nil {
+			return fmt.Errorf("failed to initialize store '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r *router) Close() {
+	r.main.Close()
+	for _, store := range r.stores {
+		store.Close()
+	}
+}
+
+func (r *router) get(name string) eventstore.Store {
+	if store, ok := r.stores[name]; ok {
+		return store
+	}
+	return r.main
+}
+
+// storeForKind returns the name of the store events of a kind go to, the first matching route wins
+func (r *router) storeForKind(kind int) string {
+	for _, route := range r.routes {
+		if route.contains(kind) {
+			return route.store
+		}
+	}
+	return "main"
+}
+
+// candidates returns all the stores that may have events matching the filter
+func (r *router) candidates(filter nostr.Filter) []eventstore.Store {
+	if filter.Kinds == nil || hasRouteScript() {
+		all := make([]eventstore.Store, 0, len(r.stores)+1)
+		all = append(all, r.main)
+		for _, store := range r.stores {
+			all = append(all, store)
+		}
+		return all
+	}
+
+	names := make([]string, 0, 2)
+	for _, kind := range filter.Kinds {
+		if name := r.storeForKind(kind); !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	stores := make([]eventstore.Store, len(names))
+	for i, name := range names {
+		stores[i] = r.get(name)
+	}
+	return stores
+}
+
+func (r *router) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	name := r.storeForKind(evt.Kind)
+	if routed := routeEvent(ctx, evt); routed != "" {
+		if _, exists := r.stores[routed]; exists || routed == "main" {
+			name = routed
+		} else {
+			log.Warn().Str("store", routed).Msg("route-event.tengo returned an unknown store")
+		}
+	}
+	return r.get(name).SaveEvent(ctx, evt)
+}
+
+func (r *router) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	// we don't know where route-event.tengo put it, so try everywhere it could be, even if
+	// some of the stores fail
+	var errs []error
+	for _, store := range r.candidates(nostr.Filter{Kinds: []int{evt.Kind}}) {
+		if err := store.DeleteEvent(ctx, evt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// QueryEvents reads everything from the stores before returning the events newest first
+func (r *router) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	stores := r.candidates(filter)
+	if len(stores) == 1 {
+		return stores[0].QueryEvents(ctx, filter)
+	}
+
+	results := make([][]*nostr.Event, len(stores))
+	errs := make([]error, len(stores))
+	wg := sync.WaitGroup{}
+	for i, store := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, err := store.QueryEvents(ctx, filter)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for evt := range ch {
+				results[i] = append(results[i], evt)
+			}
+		}()
+	}
+	wg.Wait()
+
+	events := make([]*nostr.Event, 0, 20)
+	for i, res := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		events = append(events, res...)
+	}
+	slices.SortFunc(events, func(a, b *nostr.Event) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	events = slices.CompactFunc(events, func(a, b *nostr.Event) bool { return a.ID == b.ID })
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[0:filter.Limit]
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, evt := range events {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (r *router) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	var total int64
+	for _, store := range r.candidates(filter) {
+		counter, ok := store.(eventstore.Counter)
+		if !ok {
+			return 0, fmt.Errorf("a store doesn't support counting")
+		}
+		count, err := counter.CountEvents(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+const routeEventTimeout = 5 * time.Second
+
+var (
+	routeEventCompiled    *tengo.Compiled
+	lastRouteEventModtime time.Time
+	routeEventMutex       sync.Mutex
+)
+
+func hasRouteScript() bool {
+	_, err := os.Stat(filepath.Join(s.CustomDirectory, string(ROUTE_EVENT)))
+	return err == nil
+}
+
+// routeEvent calls route-event.tengo, if it exists, to get the name of the store an event
+// should go to. an empty string means the event should be routed by kind
+func routeEvent(ctx context.Context, event *nostr.Event) (name string) {
+	fpath := filepath.Join(s.CustomDirectory, string(ROUTE_EVENT))
+	fstat, err := os.Stat(fpath)
+	if err != nil {
+		return ""
+	}
+
+	start := time.Now()
+	_, trace := traceFor(ctx, ROUTE_EVENT, event, nil)
+	if trace != nil {
+		defer func() {
+			msg := name
+			if err != nil {
+				msg = err.Error()
+			}
+			trace.finishWith(start, "route", msg)
+		}()
+	}
+
+	routeEventMutex.Lock()
+	if fstat.ModTime().After(lastRouteEventModtime) {
+		lastRouteEventModtime = fstat.ModTime()
+		script := tengo.NewScript([]byte(`
+route := import("userscript")
+res := route(event)
+`))
+
+		source, _ := os.ReadFile(fpath)
+		script.SetImports(makeModules(source))
+		script.Add("event", nil)
+
+		routeEventCompiled, err = script.Compile()
+		if err != nil {
+			metricScriptErrors.WithLabelValues(string(ROUTE_EVENT), "compile").Inc()
+			log.Warn().Err(err).Msg("route-event.tengo is invalid")
+		}
+	}
+	compiled := routeEventCompiled
+	routeEventMutex.Unlock()
+	if compiled == nil {
+		return ""
+	}
+
+	// saving waits for this, so it can't take forever
+	ctx, cancel := context.WithTimeout(ctx, routeEventTimeout)
+	defer cancel()
+
+	this := compiled.Clone()
+	this.Set("event", eventToTengo(event))
+	runStart := time.Now()
+	err = this.RunContext(ctx)
+	metricScriptDuration.WithLabelValues(string(ROUTE_EVENT)).Observe(time.Since(runStart).Seconds())
+	if err != nil {
+		metricScriptErrors.WithLabelValues(string(ROUTE_EVENT), "run").Inc()
+		log.Warn().Err(err).Msg("route-event.tengo failed to run")
+		return ""
+	}
+
+	name, _ = tengo.ToString(this.Get("res").Object())
+	return name
+}
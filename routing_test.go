@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseKindRanges(t *testing.T) {
+	for _, tc := range []struct {
+		kinds  string
+		ranges []kindRange
+		err    string
+	}{
+		{"1", []kindRange{{1, 1}}, ""},
+		{"1,7", []kindRange{{1, 1}, {7, 7}}, ""},
+		{"0,20000-29999", []kindRange{{0, 0}, {20000, 29999}}, ""},
+		{"5-5", []kindRange{{5, 5}}, ""},
+		{"", nil, "invalid kinds ''"},
+		{"1,", nil, "invalid kinds ''"},
+		{"a", nil, "invalid kinds 'a'"},
+		{"10-5", nil, "invalid kinds '10-5'"},
+		{"1-", nil, "invalid kinds '1-'"},
+		{"1-2-3", nil, "invalid kinds '1-2-3'"},
+	} {
+		t.Run(tc.kinds, func(t *testing.T) {
+			ranges, err := parseKindRanges(tc.kinds)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with '%s', got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(ranges, tc.ranges) {
+				t.Fatalf("expected %v, got %v", tc.ranges, ranges)
+			}
+		})
+	}
+}
+
+func TestRouterQueryEvents(t *testing.T) {
+	ctx := context.Background()
+
+	main, _, _ := makeEventStore("memory", "")
+	r, err := makeRouter(main, "a=memory b=memory", "1=a 7,30000-39999=b")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := r.Init(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer r.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	event := func(kind int, createdAt nostr.Timestamp) *nostr.Event {
+		evt := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: nostr.Tags{}}
+		evt.Sign(sk)
+		return evt
+	}
+	note := event(1, 30)
+	reaction := event(7, 20)
+	profile := event(0, 10)
+	article := event(30023, 15)
+	for _, evt := range []*nostr.Event{note, reaction, profile, article} {
+		if err := r.SaveEvent(ctx, evt); err != nil {
+			t.Fatalf("unexpected error saving kind %d: %s", evt.Kind, err)
+		}
+	}
+	// the same event in another store is only returned once
+	r.stores["a"].SaveEvent(ctx, reaction)
+
+	since := nostr.Timestamp(16)
+	for _, tc := range []struct {
+		name     string
+		filter   nostr.Filter
+		expected []*nostr.Event
+	}{
+		{"all", nostr.Filter{}, []*nostr.Event{note, reaction, article, profile}},
+		{"limit", nostr.Filter{Limit: 2}, []*nostr.Event{note, reaction}},
+		{"one store", nostr.Filter{Kinds: []int{7, 30023}}, []*nostr.Event{reaction, article}},
+		{"two stores", nostr.Filter{Kinds: []int{0, 1}}, []*nostr.Event{note, profile}},
+		{"since", nostr.Filter{Since: &since}, []*nostr.Event{note, reaction}},
+		{"nothing", nostr.Filter{Kinds: []int{2}}, []*nostr.Event{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ch, err := r.QueryEvents(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			events := make([]*nostr.Event, 0, len(tc.expected))
+			for evt := range ch {
+				events = append(events, evt)
+			}
+			if len(events) != len(tc.expected) {
+				t.Fatalf("expected %d events, got %d", len(tc.expected), len(events))
+			}
+			for i, evt := range events {
+				if evt.ID != tc.expected[i].ID {
+					t.Fatalf("expected kind %d at %d, got kind %d", tc.expected[i].Kind, i, evt.Kind)
+				}
+			}
+		})
+	}
+
+	// deleting tries every store the event could be in
+	if err := r.DeleteEvent(ctx, reaction); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count, _ := r.CountEvents(ctx, nostr.Filter{IDs: []string{reaction.ID}}); count != 1 {
+		t.Fatalf("expected the copy in store 'a' to still be there, got %d", count)
+	}
+}
@@ -1,26 +1,131 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
-	"sync"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/d5/tengo/v2"
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore"
 	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/puzpuzpuz/xsync/v2"
 )
 
-var sessionStorage = xsync.NewTypedMapOf[*khatru.WebSocket, store](pointerHasher)
+var sessionStorage = xsync.NewTypedMapOf[*khatru.WebSocket, *store](pointerHasher)
 
-type store struct {
-	data  map[string]tengo.Object
-	mutex sync.Mutex
+// connectionStats keeps track of what each connection has been doing so scripts can use it
+type connectionStats struct {
+	connectedAt time.Time
+	published   atomic.Int64
+	rejected    atomic.Int64
+	kicked      atomic.Bool
+
+	// the open subscriptions, from their REQ until they are rejected or closed, see
+	// subscriptionWatcher and dropRejectedSubscription
+	subscriptions *xsync.MapOf[string, *subscription]
+}
+
+// subscription has the filters of the last REQ sent with a given id. khatru handles the
+// filters of a REQ one by one, so while a filter is being checked this only has it and
+// the ones that came before it
+type subscription struct {
+	ctx     context.Context // this is the same for all the filters of the same REQ, nil before the first
+	filters []nostr.Filter
 }
 
-var globalStore = store{data: make(map[string]tengo.Object)}
+var connections = xsync.NewTypedMapOf[*khatru.WebSocket, *connectionStats](pointerHasher)
+
+// getConnectionStats returns nil for connections that are gone, so hooks that run after a
+// disconnect don't bring their stats back
+func getConnectionStats(ctx context.Context) *connectionStats {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return nil
+	}
+	stats, _ := connections.Load(ws)
+	return stats
+}
+
+func onConnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	stats, _ := connections.LoadOrCompute(ws, func() *connectionStats {
+		return &connectionStats{
+			connectedAt:   time.Now(),
+			subscriptions: xsync.NewMapOf[*subscription](),
+		}
+	})
+	if conn, ok := rawConnections.Load(ws.Request); ok {
+		conn.stats.Store(stats)
+	}
+}
 
 func onDisconnect(ctx context.Context) {
-	sessionStorage.Delete(khatru.GetConnection(ctx))
+	ws := khatru.GetConnection(ctx)
+	sessionStorage.Delete(ws)
+	connections.Delete(ws)
+	rawConnections.Delete(ws.Request)
+}
+
+func onEventAccepted(ctx context.Context, _ *nostr.Event) {
+	metricEventsAccepted.Inc()
+	if stats := getConnectionStats(ctx); stats != nil {
+		stats.published.Add(1)
+	}
+}
+
+func onFilter(ctx context.Context, filter *nostr.Filter) {
+	stats := getConnectionStats(ctx)
+	if stats == nil {
+		// the connection is gone, so we can't tell the filters of the same REQ apart
+		metricReqs.Inc()
+		return
+	}
+
+	// the subscription was added when its REQ was read, if it isn't here it was closed already
+	id := khatru.GetSubscriptionID(ctx)
+	stats.subscriptions.Compute(id, func(sub *subscription, loaded bool) (*subscription, bool) {
+		if !loaded || sub.ctx != ctx {
+			metricReqs.Inc()
+			if !loaded {
+				return nil, true
+			}
+			sub = &subscription{ctx: ctx}
+			context.AfterFunc(ctx, func() { dropRejectedSubscription(ctx, stats, id) })
+		}
+		sub.filters = append(sub.filters, *filter)
+		return sub, false
+	})
+}
+
+// makeReqObject describes the REQ the filter being checked belongs to. khatru only gives us
+// the filters one at a time, so it can't have the ones that come after this one
+func makeReqObject(ctx context.Context) tengo.Object {
+	id := khatru.GetSubscriptionID(ctx)
+	filters := &tengo.Array{Value: make([]tengo.Object, 0, 1)}
+	count := 0
+	if stats := getConnectionStats(ctx); stats != nil {
+		if sub, ok := stats.subscriptions.Load(id); ok {
+			for _, filter := range sub.filters {
+				filters.Value = append(filters.Value, filterToTengo(filter))
+			}
+		}
+		count = stats.subscriptions.Size()
+	}
+
+	return &tengo.Map{
+		Value: map[string]tengo.Object{
+			"id":            &tengo.String{Value: id},
+			"filters":       filters,
+			"subscriptions": &tengo.Int{Value: int64(count)},
+		},
+	}
 }
 
 func makeRelayObject(ctx context.Context) tengo.Object {
@@ -28,73 +133,125 @@ func makeRelayObject(ctx context.Context) tengo.Object {
 		Value: map[string]tengo.Object{
 			"query": &tengo.UserFunction{
 				Name: "query",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					ch, err := queryForScript(ctx, "query", args)
+					if err != nil {
+						return nil, err
+					}
+					return &EventIteratorWrapper{ch: ch}, nil
+				}),
+			},
+			"query_all": &tengo.UserFunction{
+				Name: "query_all",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					ch, err := queryForScript(ctx, "query_all", args)
+					if err != nil {
+						return nil, err
+					}
+					events := make([]tengo.Object, 0, 20)
+					for evt := range ch {
+						events = append(events, eventToTengo(evt))
+					}
+					return &tengo.Array{Value: events}, nil
+				}),
+			},
+			"delete": &tengo.UserFunction{
+				Name: "delete",
 				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
 					if len(args) == 0 {
-						return nil, fmt.Errorf("query function requires an argument")
+						return nil, fmt.Errorf("delete function requires an argument")
 					}
 					filter, err := filterFromTengo(args[0])
-
-					ch, err := db.QueryEvents(ctx, filter)
 					if err != nil {
-						return nil, err
+						return nil, fmt.Errorf("delete function got an invalid filter: %w", err)
 					}
-
-					return &EventIteratorWrapper{ch: ch}, nil
+					if len(filter.IDs) == 0 && len(filter.Authors) == 0 && len(filter.Kinds) == 0 && len(filter.Tags) == 0 {
+						return nil, fmt.Errorf("delete function refuses to delete everything, the filter must have ids, authors, kinds or tags")
+					}
+					deleted, err := deleteMatching(ctx, filter)
+					if err != nil {
+						return nil, fmt.Errorf("delete function failed after deleting %d events: %w", deleted, err)
+					}
+					return &tengo.Int{Value: int64(deleted)}, nil
+				}),
+			},
+			"save": &tengo.UserFunction{
+				Name: "save",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) == 0 {
+						return nil, fmt.Errorf("save function requires an argument")
+					}
+					event, err := eventFromTengo(args[0])
+					if err != nil {
+						return nil, fmt.Errorf("save function got an invalid event: %w", err)
+					}
+					if !event.CheckID() {
+						return nil, fmt.Errorf("save function got an event with an invalid id")
+					}
+					if ok, _ := event.CheckSignature(); !ok {
+						return nil, fmt.Errorf("save function got an event with an invalid signature")
+					}
+					if err := saveAndBroadcast(ctx, event); err != nil {
+						return nil, fmt.Errorf("save function failed: %w", err)
+					}
+					return nil, nil
+				}),
+			},
+			"store": traceStore(ctx, "relay.store", makeStoreObject(func() *store { return globalStore })),
+			"get_pubkey": &tengo.UserFunction{
+				Name: "get_pubkey",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					if s.RelaySecretKey == "" {
+						return &tengo.Undefined{}, nil
+					}
+					pubkey, _ := nostr.GetPublicKey(s.RelaySecretKey)
+					return &tengo.String{Value: pubkey}, nil
 				}),
 			},
-			"store": &tengo.Map{
-				Value: map[string]tengo.Object{
-					"get": &tengo.UserFunction{
-						Name: "store.get",
-						Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
-							if len(args) < 1 {
-								return nil, fmt.Errorf("store.get() needs an argument")
-							}
-							key := args[0].String()
-							globalStore.mutex.Lock()
-							defer globalStore.mutex.Unlock()
-							return globalStore.data[key], nil
-						}),
-					},
-					"set": &tengo.UserFunction{
-						Name: "store.set",
-						Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
-							if len(args) < 2 {
-								return nil, fmt.Errorf("store.get() needs two arguments")
-							}
-							key := args[0].String()
-							globalStore.mutex.Lock()
-							globalStore.data[key] = args[1]
-							globalStore.mutex.Unlock()
-							return nil, nil
-						}),
-					},
-					"del": &tengo.UserFunction{
-						Name: "store.del",
-						Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
-							if len(args) < 1 {
-								return nil, fmt.Errorf("store.get() needs an argument")
-							}
-							key := args[0].String()
-							globalStore.mutex.Lock()
-							defer globalStore.mutex.Unlock()
-							delete(globalStore.data, key)
-							return nil, nil
-						}),
-					},
-				},
+			"publish": &tengo.UserFunction{
+				Name: "publish",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) == 0 {
+						return nil, fmt.Errorf("publish function requires an argument")
+					}
+					if s.RelaySecretKey == "" {
+						return nil, fmt.Errorf("publish function needs the relay secret key to be configured")
+					}
+					event, err := eventFromTengo(args[0])
+					if err != nil {
+						return nil, fmt.Errorf("publish function got an invalid event template: %w", err)
+					}
+					if event.CreatedAt == 0 {
+						event.CreatedAt = nostr.Now()
+					}
+					if event.Tags == nil {
+						event.Tags = nostr.Tags{}
+					}
+					if err := event.Sign(s.RelaySecretKey); err != nil {
+						return nil, fmt.Errorf("publish function failed to sign: %w", err)
+					}
+					if err := saveAndBroadcast(ctx, event); err != nil {
+						return nil, fmt.Errorf("publish function failed: %w", err)
+					}
+					return eventToTengo(event), nil
+				}),
 			},
 		},
 	}
 }
 
 func makeConnectionObject(ctx context.Context) tengo.Object {
+	var userStore tengo.Object = &tengo.Undefined{}
+	if pubkey := khatru.GetAuthed(ctx); pubkey != "" {
+		userStore = traceStore(ctx, "conn.user_store", makeStoreObject(func() *store { return getUserStore(pubkey) }))
+	}
+
 	return &tengo.Map{
 		Value: map[string]tengo.Object{
 			"get_ip": &tengo.UserFunction{
 				Name: "get_ip",
 				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
-					ip := khatru.GetIP(ctx)
+					ip := getIP(ctx)
 					if ip == "" {
 						return &tengo.Undefined{}, nil
 					}
@@ -111,57 +268,594 @@ func makeConnectionObject(ctx context.Context) tengo.Object {
 					return &tengo.String{Value: pubkey}, nil
 				}),
 			},
-			"store": &tengo.Map{
-				Value: map[string]tengo.Object{
-					"get": &tengo.UserFunction{
-						Name: "store.get",
-						Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
-							if len(args) < 1 {
-								return nil, fmt.Errorf("store.get() needs an argument")
-							}
-							key := args[0].String()
-							store, _ := sessionStorage.LoadOrCompute(khatru.GetConnection(ctx), func() store {
-								return store{data: make(map[string]tengo.Object)}
-							})
-							store.mutex.Lock()
-							defer store.mutex.Unlock()
-							return store.data[key], nil
-						}),
-					},
-					"set": &tengo.UserFunction{
-						Name: "store.set",
-						Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
-							if len(args) < 2 {
-								return nil, fmt.Errorf("store.get() needs two arguments")
-							}
-							key := args[0].String()
-							store, _ := sessionStorage.LoadOrCompute(khatru.GetConnection(ctx), func() store {
-								return store{data: make(map[string]tengo.Object)}
-							})
-							store.mutex.Lock()
-							store.data[key] = args[1]
-							store.mutex.Unlock()
-							return nil, nil
-						}),
-					},
-					"del": &tengo.UserFunction{
-						Name: "store.del",
-						Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
-							if len(args) < 1 {
-								return nil, fmt.Errorf("store.get() needs an argument")
-							}
-							key := args[0].String()
-							store, _ := sessionStorage.LoadOrCompute(khatru.GetConnection(ctx), func() store {
-								return store{data: make(map[string]tengo.Object)}
-							})
-							store.mutex.Lock()
-							defer store.mutex.Unlock()
-							delete(store.data, key)
-							return nil, nil
-						}),
-					},
-				},
+			"get_user_agent": &tengo.UserFunction{
+				Name: "get_user_agent",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					return getHeader(ctx, "User-Agent"), nil
+				}),
+			},
+			"get_origin": &tengo.UserFunction{
+				Name: "get_origin",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					return getHeader(ctx, "Origin"), nil
+				}),
+			},
+			"get_header": &tengo.UserFunction{
+				Name: "get_header",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("get_header() needs an argument")
+					}
+					name, _ := tengo.ToString(args[0])
+					return getHeader(ctx, name), nil
+				}),
 			},
+			"get_challenge": &tengo.UserFunction{
+				Name: "get_challenge",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					ws := khatru.GetConnection(ctx)
+					if ws == nil {
+						return &tengo.Undefined{}, nil
+					}
+					return &tengo.String{Value: ws.Challenge}, nil
+				}),
+			},
+			"connected_at": &tengo.UserFunction{
+				Name: "connected_at",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					stats := getConnectionStats(ctx)
+					if stats == nil {
+						return &tengo.Undefined{}, nil
+					}
+					return &tengo.Int{Value: stats.connectedAt.Unix()}, nil
+				}),
+			},
+			"get_subscriptions_count": &tengo.UserFunction{
+				Name: "get_subscriptions_count",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					stats := getConnectionStats(ctx)
+					if stats == nil {
+						return &tengo.Int{Value: 0}, nil
+					}
+					return &tengo.Int{Value: int64(stats.subscriptions.Size())}, nil
+				}),
+			},
+			"get_published_count": &tengo.UserFunction{
+				Name: "get_published_count",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					stats := getConnectionStats(ctx)
+					if stats == nil {
+						return &tengo.Int{Value: 0}, nil
+					}
+					return &tengo.Int{Value: stats.published.Load()}, nil
+				}),
+			},
+			"get_rejected_count": &tengo.UserFunction{
+				Name: "get_rejected_count",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					stats := getConnectionStats(ctx)
+					if stats == nil {
+						return &tengo.Int{Value: 0}, nil
+					}
+					return &tengo.Int{Value: stats.rejected.Load()}, nil
+				}),
+			},
+			"notice": &tengo.UserFunction{
+				Name: "notice",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("notice() needs an argument")
+					}
+					ws := khatru.GetConnection(ctx)
+					if ws == nil {
+						return nil, nil
+					}
+					message, _ := tengo.ToString(args[0])
+					ws.WriteJSON(nostr.NoticeEnvelope(message))
+					return nil, nil
+				}),
+			},
+			"request_auth": &tengo.UserFunction{
+				Name: "request_auth",
+				Value: tengo.CallableFunc(func(_ ...tengo.Object) (tengo.Object, error) {
+					if khatru.GetConnection(ctx) == nil {
+						return nil, nil
+					}
+					khatru.RequestAuth(ctx)
+					return nil, nil
+				}),
+			},
+			"kick": &tengo.UserFunction{
+				Name: "kick",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					reason := ""
+					if len(args) > 0 {
+						reason, _ = tengo.ToString(args[0])
+					}
+					kick(ctx, reason)
+					return nil, nil
+				}),
+			},
+			"store": traceStore(ctx, "conn.store", makeStoreObject(func() *store {
+				st, _ := sessionStorage.LoadOrCompute(khatru.GetConnection(ctx), func() *store {
+					return newStore("")
+				})
+				return st
+			})),
+			"user_store": userStore,
 		},
 	}
 }
+
+func makeStoreObject(getStore func() *store) tengo.Object {
+	return &tengo.Map{
+		Value: map[string]tengo.Object{
+			"get": &tengo.UserFunction{
+				Name: "store.get",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("store.get() needs an argument")
+					}
+					return getStore().get(storeKey(args[0])), nil
+				}),
+			},
+			"set": &tengo.UserFunction{
+				Name: "store.set",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 2 {
+						return nil, fmt.Errorf("store.set() needs two arguments")
+					}
+					ttl, err := ttlFromArgs("store.set", args, 2)
+					if err != nil {
+						return nil, err
+					}
+					if err := getStore().set(storeKey(args[0]), args[1], ttl); err != nil {
+						return nil, fmt.Errorf("store.set() failed: %w", err)
+					}
+					return nil, nil
+				}),
+			},
+			"del": &tengo.UserFunction{
+				Name: "store.del",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("store.del() needs an argument")
+					}
+					if err := getStore().del(storeKey(args[0])); err != nil {
+						return nil, fmt.Errorf("store.del() failed: %w", err)
+					}
+					return nil, nil
+				}),
+			},
+			"incr": &tengo.UserFunction{
+				Name: "store.incr",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("store.incr() needs an argument")
+					}
+					var delta int64 = 1
+					if len(args) > 1 {
+						var ok bool
+						if delta, ok = tengo.ToInt64(args[1]); !ok {
+							return nil, fmt.Errorf("store.incr() delta must be an int")
+						}
+					}
+					ttl, err := ttlFromArgs("store.incr", args, 2)
+					if err != nil {
+						return nil, err
+					}
+					value, err := getStore().incr(storeKey(args[0]), delta, ttl)
+					if err != nil {
+						return nil, fmt.Errorf("store.incr() failed: %w", err)
+					}
+					return &tengo.Int{Value: value}, nil
+				}),
+			},
+			"cas": &tengo.UserFunction{
+				Name: "store.cas",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 3 {
+						return nil, fmt.Errorf("store.cas() needs three arguments")
+					}
+					ttl, err := ttlFromArgs("store.cas", args, 3)
+					if err != nil {
+						return nil, err
+					}
+					swapped, err := getStore().cas(storeKey(args[0]), args[1], args[2], ttl)
+					if err != nil {
+						return nil, fmt.Errorf("store.cas() failed: %w", err)
+					}
+					return tengo.FromInterface(swapped)
+				}),
+			},
+			"keys": &tengo.UserFunction{
+				Name: "store.keys",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					prefix := ""
+					if len(args) > 0 {
+						prefix, _ = tengo.ToString(args[0])
+					}
+					return stringSliceToTengo(getStore().keys(prefix)), nil
+				}),
+			},
+			"ttl": &tengo.UserFunction{
+				Name: "store.ttl",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("store.ttl() needs an argument")
+					}
+					ttl := getStore().ttl(storeKey(args[0]))
+					if ttl < 0 {
+						return nil, nil
+					}
+					return &tengo.Int{Value: int64(ttl.Seconds())}, nil
+				}),
+			},
+			"push": &tengo.UserFunction{
+				Name: "store.push",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 2 {
+						return nil, fmt.Errorf("store.push() needs two arguments")
+					}
+					ttl, err := ttlFromArgs("store.push", args, 2)
+					if err != nil {
+						return nil, err
+					}
+					length, err := getStore().push(storeKey(args[0]), args[1], ttl)
+					if err != nil {
+						return nil, fmt.Errorf("store.push() failed: %w", err)
+					}
+					return &tengo.Int{Value: int64(length)}, nil
+				}),
+			},
+			"pop": &tengo.UserFunction{
+				Name: "store.pop",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("store.pop() needs an argument")
+					}
+					value, err := getStore().pop(storeKey(args[0]))
+					if err != nil {
+						return nil, fmt.Errorf("store.pop() failed: %w", err)
+					}
+					return value, nil
+				}),
+			},
+			"sadd": &tengo.UserFunction{
+				Name: "store.sadd",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 2 {
+						return nil, fmt.Errorf("store.sadd() needs two arguments")
+					}
+					ttl, err := ttlFromArgs("store.sadd", args, 2)
+					if err != nil {
+						return nil, err
+					}
+					member, _ := tengo.ToString(args[1])
+					added, err := getStore().sadd(storeKey(args[0]), member, ttl)
+					if err != nil {
+						return nil, fmt.Errorf("store.sadd() failed: %w", err)
+					}
+					return tengo.FromInterface(added)
+				}),
+			},
+			"srem": &tengo.UserFunction{
+				Name: "store.srem",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 2 {
+						return nil, fmt.Errorf("store.srem() needs two arguments")
+					}
+					member, _ := tengo.ToString(args[1])
+					removed, err := getStore().srem(storeKey(args[0]), member)
+					if err != nil {
+						return nil, fmt.Errorf("store.srem() failed: %w", err)
+					}
+					return tengo.FromInterface(removed)
+				}),
+			},
+			"sismember": &tengo.UserFunction{
+				Name: "store.sismember",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (tengo.Object, error) {
+					if len(args) < 2 {
+						return nil, fmt.Errorf("store.sismember() needs two arguments")
+					}
+					member, _ := tengo.ToString(args[1])
+					is, err := getStore().sismember(storeKey(args[0]), member)
+					if err != nil {
+						return nil, fmt.Errorf("store.sismember() failed: %w", err)
+					}
+					return tengo.FromInterface(is)
+				}),
+			},
+		},
+	}
+}
+
+// rawConnections has the connection under each websocket, keyed by the request that opened it
+// (which khatru keeps as ws.Request), so kick can close it. see withRawConnections
+var rawConnections = xsync.NewTypedMapOf[*http.Request, *subscriptionWatcher](pointerHasher)
+
+// withRawConnections keeps the connection khatru takes over when it upgrades a request to
+// a websocket, since khatru doesn't give us a way to close it, and watches what the client
+// sends through it for subscriptionWatcher
+func withRawConnections(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(hijackRecorder{w, r}, r)
+	})
+}
+
+type hijackRecorder struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (hr hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := hr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	watcher := &subscriptionWatcher{Conn: conn}
+	rawConnections.Store(hr.r, watcher)
+	return watcher, rw, nil
+}
+
+// kick tells the client why and closes the connection, khatru then runs the disconnect hooks.
+// anything it already sent that is still being handled is rejected
+func kick(ctx context.Context, reason string) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	if stats := getConnectionStats(ctx); stats != nil {
+		stats.kicked.Store(true)
+	}
+	if reason != "" {
+		ws.WriteJSON(nostr.NoticeEnvelope(reason))
+	}
+	if len(reason) > 123 {
+		// close frames can't be bigger than 125 bytes, and the reason must stay valid utf-8
+		cut := 123
+		for cut > 0 && !utf8.RuneStart(reason[cut]) {
+			cut--
+		}
+		reason = reason[0:cut]
+	}
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	if conn, ok := rawConnections.LoadAndDelete(ws.Request); ok {
+		conn.Close()
+	}
+}
+
+func isKicked(ctx context.Context) bool {
+	stats := getConnectionStats(ctx)
+	return stats != nil && stats.kicked.Load()
+}
+
+// rejectKickedCount is the only thing done with COUNTs, since there are no scripts for them
+func rejectKickedCount(ctx context.Context, _ nostr.Filter) (reject bool, msg string) {
+	if isKicked(ctx) {
+		return true, "blocked: this connection was closed"
+	}
+	return false, ""
+}
+
+// getIP is like khatru.GetIP but doesn't panic when there is no connection
+func getIP(ctx context.Context) string {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return ""
+	}
+	return khatru.GetIPFromRequest(ws.Request)
+}
+
+func getHeader(ctx context.Context, name string) tengo.Object {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return &tengo.Undefined{}
+	}
+	value := ws.Request.Header.Get(name)
+	if value == "" {
+		return &tengo.Undefined{}
+	}
+	return &tengo.String{Value: value}
+}
+
+// storeKey uses the raw value for strings, so keys don't end up quoted
+func storeKey(o tengo.Object) string {
+	key, _ := tengo.ToString(o)
+	return key
+}
+
+// ttlFromArgs reads an optional ttl in seconds at position i
+func ttlFromArgs(fname string, args []tengo.Object, i int) (time.Duration, error) {
+	if len(args) <= i || isUndefined(args[i]) {
+		return 0, nil
+	}
+	secs, ok := tengo.ToFloat64(args[i])
+	if !ok {
+		return 0, fmt.Errorf("%s() ttl must be a number of seconds", fname)
+	}
+	if secs < 0 {
+		return 0, fmt.Errorf("%s() ttl can't be negative", fname)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// saveAndBroadcast stores an event that didn't come from a client, bypassing the reject
+// scripts, and sends it to everybody that is listening for it
+func saveAndBroadcast(ctx context.Context, event *nostr.Event) error {
+	// the same hooks khatru calls for events it receives
+	if event.IsEphemeral() {
+		for _, oee := range relay.OnEphemeralEvent {
+			oee(ctx, event)
+		}
+	} else {
+		switch err := storeEvent(ctx, db, event); err {
+		case nil:
+			for _, ons := range relay.OnEventSaved {
+				ons(ctx, event)
+			}
+		case eventstore.ErrDupEvent:
+		default:
+			return err
+		}
+	}
+
+	relay.BroadcastEvent(event)
+	return nil
+}
+
+var errNewerVersion = fmt.Errorf("a newer version of this event already exists")
+
+// storeEvent saves an event to es, deleting older versions of replaceable and addressable
+// events. it returns eventstore.ErrDupEvent if the event was already stored
+func storeEvent(ctx context.Context, es eventstore.Store, event *nostr.Event) error {
+	// not all backends check this themselves. the channels are always read to the end so
+	// the goroutines of the backends don't get stuck
+	ch, err := es.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		return err
+	}
+	dup := false
+	for range ch {
+		dup = true
+	}
+	if dup {
+		return eventstore.ErrDupEvent
+	}
+
+	if event.IsReplaceable() || event.IsAddressable() {
+		filter := nostr.Filter{Authors: []string{event.PubKey}, Kinds: []int{event.Kind}}
+		if event.IsAddressable() {
+			filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+		}
+		ch, err := es.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+		previous := make([]*nostr.Event, 0, 1)
+		newer := false
+		for evt := range ch {
+			if evt.CreatedAt > event.CreatedAt {
+				newer = true
+			}
+			previous = append(previous, evt)
+		}
+		if newer {
+			return errNewerVersion
+		}
+		for _, evt := range previous {
+			if err := es.DeleteEvent(ctx, evt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return es.SaveEvent(ctx, event)
+}
+
+// deleteMatching deletes all stored events that match the filter, querying again until
+// nothing is left since the backends will only return a limited number of events each time
+func deleteMatching(ctx context.Context, filter nostr.Filter) (int, error) {
+	deleted := make(map[string]struct{})
+	for {
+		ch, err := db.QueryEvents(ctx, filter)
+		if err != nil {
+			return len(deleted), err
+		}
+		batch := make([]*nostr.Event, 0, 100)
+		for evt := range ch {
+			if _, ok := deleted[evt.ID]; !ok {
+				batch = append(batch, evt)
+			}
+		}
+		if len(batch) == 0 {
+			// either nothing is left or what we deleted is still being returned, in which
+			// case querying again would never end
+			return len(deleted), nil
+		}
+
+		ids := make([]string, 0, len(batch))
+		for _, evt := range batch {
+			if err := db.DeleteEvent(ctx, evt); err != nil {
+				announceDeletion(ids)
+				return len(deleted), err
+			}
+			deleted[evt.ID] = struct{}{}
+			ids = append(ids, evt.ID)
+		}
+		announceDeletion(ids)
+
+		if filter.Limit > 0 && len(deleted) >= filter.Limit {
+			return len(deleted), nil
+		}
+	}
+}
+
+// announceDeletion tells subscribers that events were deleted with a kind 5 event signed by
+// the relay. it is only broadcast, not stored, and needs the relay to have a secret key
+func announceDeletion(ids []string) {
+	if len(ids) == 0 || s.RelaySecretKey == "" {
+		return
+	}
+	event := &nostr.Event{
+		Kind:      5,
+		CreatedAt: nostr.Now(),
+		Tags:      make(nostr.Tags, 0, len(ids)),
+		Content:   "deleted by the relay",
+	}
+	for _, id := range ids {
+		event.Tags = append(event.Tags, nostr.Tag{"e", id})
+	}
+	if err := event.Sign(s.RelaySecretKey); err != nil {
+		log.Warn().Err(err).Msg("failed to sign deletion announcement")
+		return
+	}
+	relay.BroadcastEvent(event)
+}
+
+// queryForScript applies the default and maximum limits to a filter given by a script and
+// reads all the results before returning them, so the query is over even if the script
+// doesn't read everything
+func queryForScript(ctx context.Context, fname string, args []tengo.Object) (chan *nostr.Event, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s function requires an argument", fname)
+	}
+	filter, err := filterFromTengo(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s function got an invalid filter: %w", fname, err)
+	}
+
+	if filter.Limit == 0 && !filter.LimitZero {
+		filter.Limit = s.ScriptQueryDefaultLimit
+	}
+	if filter.Limit > s.ScriptQueryMaxLimit {
+		filter.Limit = s.ScriptQueryMaxLimit
+	}
+
+	qctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := db.QueryEvents(qctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	results := make(chan *nostr.Event, filter.Limit)
+	for evt := range ch {
+		if len(results) == cap(results) {
+			// more than the limit, cancel stops the backend
+			break
+		}
+		results <- evt
+	}
+	close(results)
+
+	return traceQuery(ctx, fname, filter, results), nil
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib/json"
+	"github.com/fiatjaf/khatru"
+	"github.com/puzpuzpuz/xsync/v2"
+)
+
+// store holds arbitrary values set by scripts. stores with a name are persisted to the kv
+// backend under "<name>/<key>", stores without a name only live in memory
+type store struct {
+	name    string
+	data    map[string]tengo.Object
+	expires map[string]time.Time
+	mutex   sync.Mutex
+
+	// unix time of the last getUserStore() call, used to drop idle user stores
+	lastUsed atomic.Int64
+}
+
+var globalStore = newStore("relay")
+
+// userStores are keyed by the authed pubkey, so they are shared by all connections of
+// the same user and survive reconnects. they are read from kv when first used and
+// dropped from memory after userStoreIdleTimeout, see sweepStores
+var userStores = xsync.NewMapOf[*store]()
+
+const userStoreIdleTimeout = 10 * time.Minute
+
+func getUserStore(pubkey string) *store {
+	st, _ := userStores.LoadOrCompute(pubkey, func() *store {
+		st := newStore("user/" + pubkey)
+		if err := st.loadPersisted(); err != nil {
+			log.Error().Err(err).Str("pubkey", pubkey).Msg("failed to load user store")
+		}
+		return st
+	})
+	st.lastUsed.Store(time.Now().Unix())
+	return st
+}
+
+// lookupUserStore is like getUserStore but when the store isn't in memory it is read
+// from kv without being kept, for reads that shouldn't load a store for good
+func lookupUserStore(pubkey string) (*store, error) {
+	if st, ok := userStores.Load(pubkey); ok {
+		return st, nil
+	}
+	st := newStore("user/" + pubkey)
+	return st, st.loadPersisted()
+}
+
+// keepTTL can be given to save() to keep whatever expiration the key already had
+const keepTTL time.Duration = -1
+
+func newStore(name string) *store {
+	return &store{
+		name:    name,
+		data:    make(map[string]tengo.Object),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// get returns a copy of the value so scripts can't mess with what is stored
+// without going through the store methods
+func (st *store) get(key string) tengo.Object {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if value := st.load(key); value != nil {
+		return value.Copy()
+	}
+	return nil
+}
+
+// set stores a value, a ttl of 0 means it never expires
+func (st *store) set(key string, value tengo.Object, ttl time.Duration) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.save(key, value.Copy(), ttl)
+}
+
+func (st *store) del(key string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.save(key, nil, 0)
+}
+
+// incr adds delta to the int stored at key, the ttl is only applied when the key is created
+func (st *store) incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		return delta, st.save(key, &tengo.Int{Value: delta}, ttl)
+	}
+	i, ok := current.(*tengo.Int)
+	if !ok {
+		return 0, fmt.Errorf("value at '%s' is a %s, not an int", key, current.TypeName())
+	}
+	i.Value += delta
+	return i.Value, st.save(key, i, keepTTL)
+}
+
+// cas sets key to next only if its current value is equal to prev. an undefined prev
+// matches a missing key and an undefined next deletes the key
+func (st *store) cas(key string, prev tengo.Object, next tengo.Object, ttl time.Duration) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		if !isUndefined(prev) {
+			return false, nil
+		}
+	} else if isUndefined(prev) || !current.Equals(prev) {
+		return false, nil
+	}
+
+	if isUndefined(next) {
+		next = nil
+	} else {
+		next = next.Copy()
+	}
+	return true, st.save(key, next, ttl)
+}
+
+// keys returns all the keys starting with prefix, sorted
+func (st *store) keys(prefix string) []string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	keys := make([]string, 0, len(st.data))
+	for key := range st.data {
+		if strings.HasPrefix(key, prefix) && st.load(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ttl returns how long until the key expires, 0 if it doesn't expire and -1 if it doesn't exist
+func (st *store) ttl(key string) time.Duration {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.load(key) == nil {
+		return -1
+	}
+	return st.remaining(key)
+}
+
+// push appends value to the array stored at key and returns the new length
+func (st *store) push(key string, value tengo.Object, ttl time.Duration) (int, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		return 1, st.save(key, &tengo.Array{Value: []tengo.Object{value.Copy()}}, ttl)
+	}
+	arr, ok := current.(*tengo.Array)
+	if !ok {
+		return 0, fmt.Errorf("value at '%s' is a %s, not an array", key, current.TypeName())
+	}
+	arr.Value = append(arr.Value, value.Copy())
+	return len(arr.Value), st.save(key, arr, keepTTL)
+}
+
+// pop removes the last item of the array stored at key and returns it
+func (st *store) pop(key string) (tengo.Object, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		return nil, nil
+	}
+	arr, ok := current.(*tengo.Array)
+	if !ok {
+		return nil, fmt.Errorf("value at '%s' is a %s, not an array", key, current.TypeName())
+	}
+	if len(arr.Value) == 0 {
+		return nil, nil
+	}
+	last := arr.Value[len(arr.Value)-1]
+	arr.Value = arr.Value[0 : len(arr.Value)-1]
+	return last, st.save(key, arr, keepTTL)
+}
+
+// sadd adds member to the set (a map of members to true) stored at key, returns false if
+// it was already there
+func (st *store) sadd(key string, member string, ttl time.Duration) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		set := &tengo.Map{Value: map[string]tengo.Object{member: tengo.TrueValue}}
+		return true, st.save(key, set, ttl)
+	}
+	set, ok := current.(*tengo.Map)
+	if !ok {
+		return false, fmt.Errorf("value at '%s' is a %s, not a set", key, current.TypeName())
+	}
+	if _, exists := set.Value[member]; exists {
+		return false, nil
+	}
+	set.Value[member] = tengo.TrueValue
+	return true, st.save(key, set, keepTTL)
+}
+
+// srem removes member from the set stored at key, returns false if it wasn't there
+func (st *store) srem(key string, member string) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		return false, nil
+	}
+	set, ok := current.(*tengo.Map)
+	if !ok {
+		return false, fmt.Errorf("value at '%s' is a %s, not a set", key, current.TypeName())
+	}
+	if _, exists := set.Value[member]; !exists {
+		return false, nil
+	}
+	delete(set.Value, member)
+	return true, st.save(key, set, keepTTL)
+}
+
+func (st *store) sismember(key string, member string) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	current := st.load(key)
+	if current == nil {
+		return false, nil
+	}
+	set, ok := current.(*tengo.Map)
+	if !ok {
+		return false, fmt.Errorf("value at '%s' is a %s, not a set", key, current.TypeName())
+	}
+	_, exists := set.Value[member]
+	return exists, nil
+}
+
+// size is the number of keys, including expired keys that weren't swept yet
+func (st *store) size() int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return len(st.data)
+}
+
+type storeEntry struct {
+	value tengo.Object
+	ttl   time.Duration
+}
+
+// dump returns copies of all values that haven't expired along with their ttl
+func (st *store) dump() map[string]storeEntry {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	entries := make(map[string]storeEntry, len(st.data))
+	for key := range st.data {
+		if value := st.load(key); value != nil {
+			entries[key] = storeEntry{value: value.Copy(), ttl: st.remaining(key)}
+		}
+	}
+	return entries
+}
+
+// sweep removes all expired keys, deleting them from kv is only queued so nothing here
+// waits for the disk
+func (st *store) sweep(now time.Time) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for key, expires := range st.expires {
+		if now.After(expires) {
+			st.save(key, nil, 0)
+		}
+	}
+}
+
+// load must be called with the mutex held, it returns nil for missing and expired keys
+func (st *store) load(key string) tengo.Object {
+	if expires, ok := st.expires[key]; ok && time.Now().After(expires) {
+		st.save(key, nil, 0)
+		return nil
+	}
+	return st.data[key]
+}
+
+// remaining must be called with the mutex held, it returns 0 for keys without expiration
+func (st *store) remaining(key string) time.Duration {
+	if expires, ok := st.expires[key]; ok {
+		return time.Until(expires)
+	}
+	return 0
+}
+
+// save must be called with the mutex held, a nil value deletes the key
+func (st *store) save(key string, value tengo.Object, ttl time.Duration) error {
+	persistent := st.name != "" && kv != nil && !isMemoryOnly(key)
+
+	// values that can't be persisted are refused before anything changes
+	var encoded map[string]any
+	if persistent && value != nil {
+		var err error
+		encoded, err = encodeValue(value)
+		if err != nil {
+			return fmt.Errorf("can't store '%s': %w", key, err)
+		}
+	}
+
+	if value == nil {
+		delete(st.data, key)
+		delete(st.expires, key)
+	} else {
+		st.data[key] = value
+		if ttl > 0 {
+			st.expires[key] = time.Now().Add(ttl)
+		} else if ttl == 0 {
+			delete(st.expires, key)
+		}
+	}
+
+	if persistent {
+		st.persist(key, encoded)
+	}
+	return nil
+}
+
+// persist must be called with the mutex held, a nil value deletes the key. the write
+// happens later, see queueKVWrite
+func (st *store) persist(key string, encoded map[string]any) {
+	if encoded == nil {
+		queueKVWrite(st.name+"/"+key, nil)
+		return
+	}
+
+	entry := storedEntry{Value: encoded}
+	if expires, ok := st.expires[key]; ok {
+		entry.Expires = expires.Unix()
+	}
+	// values from encodeValue can always be marshaled
+	b, _ := stdjson.Marshal(entry)
+	queueKVWrite(st.name+"/"+key, b)
+}
+
+// storedEntry is how values are saved in kv, Legacy is the format used before values were
+// tagged with their types
+type storedEntry struct {
+	Value   map[string]any     `json:"v,omitempty"`
+	Legacy  stdjson.RawMessage `json:"value,omitempty"`
+	Expires int64              `json:"expires,omitempty"`
+}
+
+// encodeValue tags each value with its type, so that floats, bytes, chars and times come
+// back as they were and not as whatever json turns them into
+func encodeValue(o tengo.Object) (map[string]any, error) {
+	switch v := o.(type) {
+	case *tengo.Int:
+		return map[string]any{"int": v.Value}, nil
+	case *tengo.Float:
+		if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+			return nil, fmt.Errorf("%v can't be stored", v.Value)
+		}
+		return map[string]any{"float": v.Value}, nil
+	case *tengo.String:
+		return map[string]any{"string": v.Value}, nil
+	case *tengo.Bool:
+		return map[string]any{"bool": !v.IsFalsy()}, nil
+	case *tengo.Char:
+		return map[string]any{"char": string(v.Value)}, nil
+	case *tengo.Bytes:
+		return map[string]any{"bytes": v.Value}, nil
+	case *tengo.Time:
+		return map[string]any{"time": v.Value}, nil
+	case *tengo.Undefined:
+		return map[string]any{"undefined": true}, nil
+	case *tengo.Array:
+		return encodeArray(v.Value)
+	case *tengo.ImmutableArray:
+		return encodeArray(v.Value)
+	case *tengo.Map:
+		return encodeMap(v.Value)
+	case *tengo.ImmutableMap:
+		return encodeMap(v.Value)
+	case *EventObject:
+		return encodeValue(v.Copy())
+	default:
+		return nil, fmt.Errorf("a %s can't be stored", o.TypeName())
+	}
+}
+
+func encodeArray(items []tengo.Object) (map[string]any, error) {
+	encoded := make([]any, len(items))
+	for i, item := range items {
+		e, err := encodeValue(item)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = e
+	}
+	return map[string]any{"array": encoded}, nil
+}
+
+func encodeMap(items map[string]tengo.Object) (map[string]any, error) {
+	encoded := make(map[string]any, len(items))
+	for k, item := range items {
+		e, err := encodeValue(item)
+		if err != nil {
+			return nil, err
+		}
+		encoded[k] = e
+	}
+	return map[string]any{"map": encoded}, nil
+}
+
+// decodeValue reverses encodeValue, the json must have been decoded with UseNumber()
+func decodeValue(tagged map[string]any) (tengo.Object, error) {
+	if len(tagged) != 1 {
+		return nil, fmt.Errorf("invalid value")
+	}
+	for tag, v := range tagged {
+		switch tag {
+		case "int":
+			n, ok := v.(stdjson.Number)
+			if !ok {
+				break
+			}
+			i, err := n.Int64()
+			if err != nil {
+				return nil, err
+			}
+			return &tengo.Int{Value: i}, nil
+		case "float":
+			n, ok := v.(stdjson.Number)
+			if !ok {
+				break
+			}
+			f, err := n.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return &tengo.Float{Value: f}, nil
+		case "string":
+			if str, ok := v.(string); ok {
+				return &tengo.String{Value: str}, nil
+			}
+		case "bool":
+			if b, ok := v.(bool); ok {
+				if b {
+					return tengo.TrueValue, nil
+				}
+				return tengo.FalseValue, nil
+			}
+		case "char":
+			if str, ok := v.(string); ok {
+				for _, r := range str {
+					return &tengo.Char{Value: r}, nil
+				}
+			}
+		case "bytes":
+			if str, ok := v.(string); ok {
+				b, err := base64.StdEncoding.DecodeString(str)
+				if err != nil {
+					return nil, err
+				}
+				return &tengo.Bytes{Value: b}, nil
+			}
+		case "time":
+			if str, ok := v.(string); ok {
+				t, err := time.Parse(time.RFC3339Nano, str)
+				if err != nil {
+					return nil, err
+				}
+				return &tengo.Time{Value: t}, nil
+			}
+		case "undefined":
+			return tengo.UndefinedValue, nil
+		case "array":
+			if items, ok := v.([]any); ok {
+				arr := make([]tengo.Object, len(items))
+				for i, item := range items {
+					itemMap, _ := item.(map[string]any)
+					o, err := decodeValue(itemMap)
+					if err != nil {
+						return nil, err
+					}
+					arr[i] = o
+				}
+				return &tengo.Array{Value: arr}, nil
+			}
+		case "map":
+			if items, ok := v.(map[string]any); ok {
+				m := make(map[string]tengo.Object, len(items))
+				for k, item := range items {
+					itemMap, _ := item.(map[string]any)
+					o, err := decodeValue(itemMap)
+					if err != nil {
+						return nil, err
+					}
+					m[k] = o
+				}
+				return &tengo.Map{Value: m}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid %s value", tag)
+	}
+	return nil, nil
+}
+
+// isMemoryOnly checks if the key namespace (the part before the first ':') is one of
+// the namespaces that shouldn't be persisted
+func isMemoryOnly(key string) bool {
+	if s.StoreMemoryNamespaces == "" {
+		return false
+	}
+	namespace, _, found := strings.Cut(key, ":")
+	if !found {
+		return false
+	}
+	for _, ns := range strings.Split(s.StoreMemoryNamespaces, ",") {
+		if strings.TrimSpace(ns) == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func isUndefined(o tengo.Object) bool {
+	if o == nil {
+		return true
+	}
+	_, ok := o.(*tengo.Undefined)
+	return ok
+}
+
+// loadStores reads the relay store back from kv, user stores are read when they are used
+func loadStores() error {
+	return globalStore.loadPersisted()
+}
+
+// loadPersisted reads the keys of this store back from kv
+func (st *store) loadPersisted() error {
+	if st.name == "" || kv == nil {
+		return nil
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	prefix := st.name + "/"
+	return readKV(prefix, func(fullKey string, value []byte) {
+		key := strings.TrimPrefix(fullKey, prefix)
+
+		entry := storedEntry{}
+		dec := stdjson.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+		if err := dec.Decode(&entry); err != nil {
+			log.Warn().Err(err).Str("key", fullKey).Msg("failed to decode stored value")
+			return
+		}
+
+		var o tengo.Object
+		var err error
+		if entry.Value != nil {
+			o, err = decodeValue(entry.Value)
+		} else {
+			o, err = json.Decode(entry.Legacy)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("key", fullKey).Msg("failed to decode stored value")
+			return
+		}
+
+		if entry.Expires != 0 {
+			expires := time.Unix(entry.Expires, 0)
+			if now.After(expires) {
+				queueKVWrite(fullKey, nil)
+				return
+			}
+			st.expires[key] = expires
+		}
+		st.data[key] = o
+	})
+}
+
+// evictable checks if a user store can be dropped from memory without losing anything,
+// that is, it wasn't used for a while and all of its keys are in kv
+func (st *store) evictable(now time.Time) bool {
+	if _, ok := kv.(memoryKV); ok || kv == nil {
+		return false
+	}
+	if now.Sub(time.Unix(st.lastUsed.Load(), 0)) < userStoreIdleTimeout {
+		return false
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for key := range st.data {
+		if isMemoryOnly(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// sweepStores periodically removes expired keys from all stores and drops idle user stores
+func sweepStores(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			globalStore.sweep(now)
+			userStores.Range(func(pubkey string, st *store) bool {
+				st.sweep(now)
+				userStores.Compute(pubkey, func(st *store, loaded bool) (*store, bool) {
+					return st, loaded && st.evictable(now)
+				})
+				return true
+			})
+			sessionStorage.Range(func(_ *khatru.WebSocket, st *store) bool {
+				st.sweep(now)
+				return true
+			})
+		}
+	}
+}
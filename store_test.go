@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestEncodeValue(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		typeName string
+		err      string
+	}{
+		{`1`, "int", ""},
+		{`-9007199254740993`, "int", ""},
+		{`1.0`, "float", ""},
+		{`0.1`, "float", ""},
+		{`"hi"`, "string", ""},
+		{`""`, "string", ""},
+		{`true`, "bool", ""},
+		{`false`, "bool", ""},
+		{`'x'`, "char", ""},
+		{`'é'`, "char", ""},
+		{`bytes("a\x00b")`, "bytes", ""},
+		{`times.date(2024, 1, 2, 3, 4, 5, 6, "UTC")`, "time", ""},
+		{`undefined`, "undefined", ""},
+		{`[1, 1.5, "a", [true], {x: 'c'}]`, "array", ""},
+		{`immutable([1])`, "array", ""},
+		{`{a: 1, b: {c: [bytes("x"), undefined]}}`, "map", ""},
+		{`immutable({a: 1.0})`, "map", ""},
+		{`{}`, "map", ""},
+		{`[]`, "array", ""},
+		{`1.0 / 0`, "", "can't be stored"},
+		{`[func() {}]`, "", "can't be stored"},
+		{`{a: error("x")}`, "", "can't be stored"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			script := tengo.NewScript([]byte(`times := import("times"); v := ` + tc.expr))
+			script.SetImports(stdlib.GetModuleMap("times"))
+			compiled, err := script.Run()
+			if err != nil {
+				t.Fatalf("invalid expression %s: %s", tc.expr, err)
+			}
+			value := compiled.Get("v").Object()
+
+			encoded, err := encodeValue(value)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with '%s', got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// the same way it goes through kv
+			j, err := stdjson.Marshal(storedEntry{Value: encoded})
+			if err != nil {
+				t.Fatalf("failed to marshal: %s", err)
+			}
+			entry := storedEntry{}
+			dec := stdjson.NewDecoder(bytes.NewReader(j))
+			dec.UseNumber()
+			if err := dec.Decode(&entry); err != nil {
+				t.Fatalf("failed to unmarshal %s: %s", j, err)
+			}
+			decoded, err := decodeValue(entry.Value)
+			if err != nil {
+				t.Fatalf("failed to decode %s: %s", j, err)
+			}
+
+			if decoded.TypeName() != tc.typeName {
+				t.Fatalf("expected a %s, got a %s from %s", tc.typeName, decoded.TypeName(), j)
+			}
+			if !sameValue(decoded, value) {
+				t.Fatalf("expected %s, got %s from %s", value, decoded, j)
+			}
+		})
+	}
+}
+
+// sameValue is like Equals but also checks the types inside arrays and maps, immutable
+// ones are the same as mutable ones since they are stored the same way
+func sameValue(a, b tengo.Object) bool {
+	items := func(o tengo.Object) ([]tengo.Object, map[string]tengo.Object) {
+		switch v := o.(type) {
+		case *tengo.Array:
+			return v.Value, nil
+		case *tengo.ImmutableArray:
+			return v.Value, nil
+		case *tengo.Map:
+			return nil, v.Value
+		case *tengo.ImmutableMap:
+			return nil, v.Value
+		}
+		return nil, nil
+	}
+	aArr, aMap := items(a)
+	bArr, bMap := items(b)
+	switch {
+	case aArr != nil || bArr != nil:
+		if len(aArr) != len(bArr) {
+			return false
+		}
+		for i := range aArr {
+			if !sameValue(aArr[i], bArr[i]) {
+				return false
+			}
+		}
+		return true
+	case aMap != nil || bMap != nil:
+		if len(aMap) != len(bMap) {
+			return false
+		}
+		for k := range aMap {
+			if !sameValue(aMap[k], bMap[k]) {
+				return false
+			}
+		}
+		return true
+	case a.TypeName() != b.TypeName():
+		return false
+	case a == tengo.UndefinedValue:
+		return b == tengo.UndefinedValue
+	default:
+		return a.Equals(b)
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	previous := kv
+	defer func() { kv = previous }()
+
+	for _, backend := range []string{"sqlite", "lmdb", "badger"} {
+		t.Run(backend, func(t *testing.T) {
+			kvb, err := makeKVBackend(backend, filepath.Join(t.TempDir(), "store"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := kvb.Init(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer kvb.Close()
+			kv = kvb
+
+			st := newStore("user/" + nostr.GeneratePrivateKey())
+			reload := func() {
+				t.Helper()
+				if err := flushKV(); err != nil {
+					t.Fatalf("failed to flush: %s", err)
+				}
+				st = newStore(st.name)
+				if err := st.loadPersisted(); err != nil {
+					t.Fatalf("failed to load: %s", err)
+				}
+			}
+
+			if n, err := st.incr("n", 2, 0); err != nil || n != 2 {
+				t.Fatalf("expected 2, got %d, %v", n, err)
+			}
+			st.set("f", &tengo.Float{Value: 2}, time.Hour)
+			st.set("gone", &tengo.Int{Value: 1}, time.Hour)
+			st.del("gone")
+			reload()
+
+			if n, err := st.incr("n", 3, 0); err != nil || n != 5 {
+				t.Fatalf("expected 5 after reloading, got %d, %v", n, err)
+			}
+			if _, err := st.incr("f", 1, 0); err == nil {
+				t.Fatalf("expected the float to still be a float after reloading")
+			}
+			if ttl := st.ttl("f"); ttl <= 59*time.Minute {
+				t.Fatalf("expected the ttl to be kept after reloading, got %s", ttl)
+			}
+			if st.get("gone") != nil {
+				t.Fatalf("expected the deleted key to stay deleted after reloading")
+			}
+			reload()
+
+			if ok, err := st.cas("f", &tengo.Int{Value: 2}, &tengo.Int{Value: 3}, 0); err != nil || ok {
+				t.Fatalf("expected cas with an int to fail on a float, got %v, %v", ok, err)
+			}
+			if ok, err := st.cas("f", &tengo.Float{Value: 2}, &tengo.String{Value: "x"}, 0); err != nil || !ok {
+				t.Fatalf("expected cas with the float to work, got %v, %v", ok, err)
+			}
+			if ok, err := st.cas("new", tengo.UndefinedValue, &tengo.Int{Value: 1}, 0); err != nil || !ok {
+				t.Fatalf("expected cas on a missing key to work, got %v, %v", ok, err)
+			}
+			reload()
+
+			if v := st.get("f"); v == nil || !v.Equals(&tengo.String{Value: "x"}) {
+				t.Fatalf("expected 'x' after reloading, got %v", v)
+			}
+			if v := st.get("n"); v == nil || !v.Equals(&tengo.Int{Value: 5}) {
+				t.Fatalf("expected 5 after reloading, got %v", v)
+			}
+			if ok, _ := st.cas("new", tengo.UndefinedValue, &tengo.Int{Value: 2}, 0); ok {
+				t.Fatalf("expected cas on a key that exists after reloading to fail")
+			}
+		})
+	}
+}
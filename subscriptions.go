@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// subscriptionWatcher reads the websocket frames the client sends, as khatru reads them from
+// the connection, to see the REQs and CLOSEs in the order they were sent. khatru doesn't tell
+// us when a subscription is closed after EOSE, so this is how connectionStats.subscriptions
+// knows which subscriptions are still open
+type subscriptionWatcher struct {
+	net.Conn
+	stats atomic.Pointer[connectionStats] // set by onConnect
+
+	// the frame being read, only Read touches these
+	header    []byte
+	inFrame   bool
+	remaining uint64
+	fin       bool
+	control   bool
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	// the text message being read, only kept while it may be a REQ or a CLOSE
+	message []byte
+	keep    bool
+}
+
+// labelLength is how far we look for the comma after the label of a message
+const labelLength = 32
+
+func (sw *subscriptionWatcher) Read(p []byte) (int, error) {
+	n, err := sw.Conn.Read(p)
+	sw.feed(p[0:n])
+	return n, err
+}
+
+func (sw *subscriptionWatcher) feed(data []byte) {
+	for len(data) > 0 {
+		if !sw.inFrame {
+			sw.header = append(sw.header, data[0])
+			data = data[1:]
+			if len(sw.header) < frameHeaderLength(sw.header) {
+				continue
+			}
+			sw.startFrame()
+			if sw.remaining == 0 {
+				sw.endFrame()
+			}
+			continue
+		}
+
+		take := data[0:min(uint64(len(data)), sw.remaining)]
+		if !sw.control && sw.keep {
+			for _, b := range take {
+				if sw.masked {
+					b ^= sw.mask[sw.maskPos%4]
+				}
+				sw.maskPos++
+				sw.message = append(sw.message, b)
+			}
+			sw.checkLabel(false)
+		}
+		sw.remaining -= uint64(len(take))
+		data = data[len(take):]
+		if sw.remaining == 0 {
+			sw.endFrame()
+		}
+	}
+}
+
+// frameHeaderLength is the length of a websocket frame header, given as much of it as is
+// needed to know that
+func frameHeaderLength(header []byte) int {
+	if len(header) < 2 {
+		return 2
+	}
+	length := 2
+	switch header[1] & 0x7f {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+	if header[1]&0x80 != 0 {
+		length += 4
+	}
+	return length
+}
+
+func (sw *subscriptionWatcher) startFrame() {
+	h := sw.header
+	sw.header = sw.header[:0]
+	sw.inFrame = true
+	sw.fin = h[0]&0x80 != 0
+	opcode := h[0] & 0x0f
+	sw.control = opcode >= 8
+
+	pos := 2
+	switch h[1] & 0x7f {
+	case 126:
+		sw.remaining = uint64(h[2])<<8 | uint64(h[3])
+		pos += 2
+	case 127:
+		sw.remaining = 0
+		for _, b := range h[2:10] {
+			sw.remaining = sw.remaining<<8 | uint64(b)
+		}
+		pos += 8
+	default:
+		sw.remaining = uint64(h[1] & 0x7f)
+	}
+	sw.masked = h[1]&0x80 != 0
+	if sw.masked {
+		copy(sw.mask[:], h[pos:pos+4])
+	}
+	sw.maskPos = 0
+
+	switch opcode {
+	case 1: // text, a new message
+		if cap(sw.message) > 64*1024 {
+			// don't hold on to the space used by a big REQ
+			sw.message = nil
+		}
+		sw.message = sw.message[:0]
+		sw.keep = true
+	case 2: // binary, nostr doesn't use these
+		sw.keep = false
+	}
+}
+
+func (sw *subscriptionWatcher) endFrame() {
+	sw.inFrame = false
+	if sw.control || !sw.fin {
+		return
+	}
+	sw.checkLabel(true)
+	if !sw.keep {
+		return
+	}
+	sw.keep = false
+
+	stats := sw.stats.Load()
+	if stats == nil {
+		return
+	}
+	// parsed the same way khatru does, so we only count what it will handle
+	switch env := nostr.ParseMessage(sw.message).(type) {
+	case *nostr.ReqEnvelope:
+		if len(env.Filters) == 0 {
+			return
+		}
+		// a REQ with an id that is already open replaces it, which onFilter takes care of
+		stats.subscriptions.LoadOrCompute(env.SubscriptionID, func() *subscription {
+			return &subscription{}
+		})
+	case *nostr.CloseEnvelope:
+		stats.subscriptions.Delete(string(*env))
+	}
+}
+
+// checkLabel stops keeping the message as soon as its label (what comes before the first
+// comma, like nostr.ParseMessage takes it) shows it can't be a REQ or a CLOSE
+func (sw *subscriptionWatcher) checkLabel(ended bool) {
+	if !sw.keep {
+		return
+	}
+	comma := bytes.IndexByte(sw.message, ',')
+	if comma == -1 {
+		if ended || len(sw.message) > labelLength {
+			sw.keep = false
+		}
+		return
+	}
+	label := sw.message[0:comma]
+	if bytes.Contains(label, []byte("EVENT")) ||
+		!(bytes.Contains(label, []byte("REQ")) || bytes.Contains(label, []byte("CLOSE"))) ||
+		int64(len(sw.message)) > relay.MaxMessageSize {
+		sw.keep = false
+	}
+}
+
+// dropRejectedSubscription removes a subscription when khatru ends its context because a
+// filter was rejected or it was closed before EOSE. at EOSE the context is also ended, but
+// with no cause, and the subscription stays open
+func dropRejectedSubscription(ctx context.Context, stats *connectionStats, id string) {
+	if errors.Is(context.Cause(ctx), context.Canceled) {
+		return
+	}
+	stats.subscriptions.Compute(id, func(current *subscription, loaded bool) (*subscription, bool) {
+		return current, loaded && current.ctx == ctx
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/puzpuzpuz/xsync/v2"
+)
+
+// frame encodes a websocket frame like a client sends it
+func frame(fin bool, opcode byte, payload string, masked bool) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) < 1<<16:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i := 0; i < len(payload); i++ {
+		b = append(b, payload[i]^mask[i%4])
+	}
+	return b
+}
+
+func text(payload string) []byte { return frame(true, 1, payload, true) }
+
+func TestSubscriptionWatcher(t *testing.T) {
+	bigREQ := `["REQ","big",{"search":"` + strings.Repeat("x", 70000) + `"}]`
+	mediumREQ := `["REQ","medium",{"search":"` + strings.Repeat("x", 200) + `"}]`
+
+	for _, tc := range []struct {
+		name     string
+		frames   [][]byte
+		expected []string
+	}{
+		{"req", [][]byte{text(`["REQ","a",{}]`)}, []string{"a"}},
+		{"req and close", [][]byte{text(`["REQ","a",{}]`), text(`["REQ","b",{}]`), text(`["CLOSE","a"]`)}, []string{"b"}},
+		{"same id", [][]byte{text(`["REQ","a",{}]`), text(`["REQ","a",{"kinds":[1]}]`)}, []string{"a"}},
+		{"spaces", [][]byte{text(` [ "REQ" , "a", {} ] `)}, []string{"a"}},
+		{"no filters", [][]byte{text(`["REQ","a"]`)}, []string{}},
+		{"invalid", [][]byte{text(`["REQ","a",{"kinds":"1"}]`), text(`["REQ"`), text(`[]`)}, []string{}},
+		{"close of nothing", [][]byte{text(`["CLOSE","a"]`)}, []string{}},
+		{"other messages", [][]byte{
+			text(`["EVENT",{"content":"[\"REQ\",\"a\",{}]"}]`),
+			text(`["COUNT","a",{}]`),
+			text(`["AUTH",{}]`),
+		}, []string{}},
+		{"lengths", [][]byte{text(mediumREQ), text(bigREQ)}, []string{"big", "medium"}},
+		{"unmasked", [][]byte{frame(true, 1, `["REQ","a",{}]`, false)}, []string{"a"}},
+		{"binary", [][]byte{frame(true, 2, `["REQ","a",{}]`, true)}, []string{}},
+		{"fragmented", [][]byte{
+			text(`["REQ","a",{}]`),
+			frame(false, 1, `["CLO`, true),
+			frame(true, 9, "ping", true),
+			frame(false, 0, `SE",`, true),
+			frame(true, 0, `"a"]`, true),
+			frame(false, 1, `["REQ","b",`, true),
+			frame(true, 0, `{}]`, true),
+		}, []string{"b"}},
+		{"empty frames", [][]byte{
+			frame(true, 10, "", true),
+			frame(false, 1, "", true),
+			frame(true, 0, `["REQ","a",{}]`, true),
+		}, []string{"a"}},
+	} {
+		for _, chunk := range []int{1, 3, 1 << 20} {
+			stream := slices.Concat(tc.frames...)
+			sw := &subscriptionWatcher{}
+			stats := &connectionStats{subscriptions: xsync.NewMapOf[*subscription]()}
+			sw.stats.Store(stats)
+			for i := 0; i < len(stream); i += chunk {
+				sw.feed(stream[i:min(i+chunk, len(stream))])
+			}
+
+			ids := make([]string, 0, 2)
+			stats.subscriptions.Range(func(id string, _ *subscription) bool {
+				ids = append(ids, id)
+				return true
+			})
+			slices.Sort(ids)
+			if !slices.Equal(ids, tc.expected) {
+				t.Errorf("%s, read %d bytes at a time: expected %v, got %v", tc.name, chunk, tc.expected, ids)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/d5/tengo/v2"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip44"
+)
+
+var tengoCrypto = map[string]tengo.Object{
+	"sha256": &tengo.UserFunction{
+		Name: "crypto.sha256",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("crypto.sha256() needs an argument")
+			}
+			data, ok := tengo.ToByteSlice(args[0])
+			if !ok {
+				return nil, fmt.Errorf("crypto.sha256() argument must be a string or bytes")
+			}
+			hash := sha256.Sum256(data)
+			return &tengo.String{Value: hex.EncodeToString(hash[:])}, nil
+		}),
+	},
+	"hmac_sha256": &tengo.UserFunction{
+		Name: "crypto.hmac_sha256",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("crypto.hmac_sha256() needs two arguments")
+			}
+			key, ok := tengo.ToByteSlice(args[0])
+			if !ok {
+				return nil, fmt.Errorf("crypto.hmac_sha256() key must be a string or bytes")
+			}
+			data, ok := tengo.ToByteSlice(args[1])
+			if !ok {
+				return nil, fmt.Errorf("crypto.hmac_sha256() data must be a string or bytes")
+			}
+			mac := hmac.New(sha256.New, key)
+			mac.Write(data)
+			return &tengo.String{Value: hex.EncodeToString(mac.Sum(nil))}, nil
+		}),
+	},
+	"nip44_decrypt": &tengo.UserFunction{
+		Name: "crypto.nip44_decrypt",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			ciphertext, sender, err := getDecryptArgs("crypto.nip44_decrypt", args)
+			if err != nil {
+				return nil, err
+			}
+			key, err := nip44.GenerateConversationKey(sender, s.RelaySecretKey)
+			if err != nil {
+				return nil, fmt.Errorf("crypto.nip44_decrypt() failed to compute conversation key: %w", err)
+			}
+			plaintext, err := nip44.Decrypt(ciphertext, key)
+			if err != nil {
+				return nil, fmt.Errorf("crypto.nip44_decrypt() failed to decrypt: %w", err)
+			}
+			return &tengo.String{Value: plaintext}, nil
+		}),
+	},
+	"nip04_decrypt": &tengo.UserFunction{
+		Name: "crypto.nip04_decrypt",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			ciphertext, sender, err := getDecryptArgs("crypto.nip04_decrypt", args)
+			if err != nil {
+				return nil, err
+			}
+			key, err := nip04.ComputeSharedSecret(sender, s.RelaySecretKey)
+			if err != nil {
+				return nil, fmt.Errorf("crypto.nip04_decrypt() failed to compute shared secret: %w", err)
+			}
+			plaintext, err := nip04.Decrypt(ciphertext, key)
+			if err != nil {
+				return nil, fmt.Errorf("crypto.nip04_decrypt() failed to decrypt: %w", err)
+			}
+			return &tengo.String{Value: plaintext}, nil
+		}),
+	},
+}
+
+func getDecryptArgs(fname string, args []tengo.Object) (ciphertext string, sender string, err error) {
+	if s.RelaySecretKey == "" {
+		return "", "", fmt.Errorf("%s() needs the relay secret key to be configured", fname)
+	}
+	if len(args) < 2 {
+		return "", "", fmt.Errorf("%s() needs two arguments", fname)
+	}
+	c, ok := args[0].(*tengo.String)
+	if !ok {
+		return "", "", fmt.Errorf("%s() ciphertext must be a string", fname)
+	}
+	p, ok := args[1].(*tengo.String)
+	if !ok {
+		return "", "", fmt.Errorf("%s() sender pubkey must be a string", fname)
+	}
+	return c.Value, p.Value, nil
+}
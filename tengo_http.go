@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib/json"
 )
 
 var tengoHttp = map[string]tengo.Object{
@@ -22,22 +29,318 @@ var tengoHttp = map[string]tengo.Object{
 				return nil, fmt.Errorf("http.get() argument must be a string")
 			}
 
-			resp, err := http.Get(url.Value)
+			resp, err := doHttpRequest("http.get", "GET", url.Value, nil, nil, 0)
 			if err != nil {
-				return nil, fmt.Errorf("http.get() failed to call '%s': %w", url.Value, err)
+				return nil, err
+			}
+			if resp.status >= 300 {
+				return nil, fmt.Errorf("http.get() got a status code %d from '%s'", resp.status, url.Value)
+			}
+
+			return resp.tengoBody(), nil
+		}),
+	},
+	"post": &tengo.UserFunction{
+		Name: "http.post",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("http.post() needs at least two arguments")
+			}
+
+			url, ok := args[0].(*tengo.String)
+			if !ok {
+				return nil, fmt.Errorf("http.post() first argument must be a string")
+			}
+
+			var headers tengo.Object
+			if len(args) > 2 {
+				headers = args[2]
+			}
+
+			resp, err := doHttpRequest("http.post", "POST", url.Value, headers, args[1], 0)
+			if err != nil {
+				return nil, err
+			}
+			if resp.status >= 300 {
+				return nil, fmt.Errorf("http.post() got a status code %d from '%s'", resp.status, url.Value)
+			}
+
+			return resp.tengoBody(), nil
+		}),
+	},
+	"request": &tengo.UserFunction{
+		Name: "http.request",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("http.request() needs an argument")
 			}
-			defer resp.Body.Close()
 
-			if resp.StatusCode >= 300 {
-				return nil, fmt.Errorf("http.get() got a status code %d from '%s'", resp.StatusCode, url.Value)
+			var params map[string]tengo.Object
+			switch o := args[0].(type) {
+			case *tengo.Map:
+				params = o.Value
+			case *tengo.ImmutableMap:
+				params = o.Value
+			default:
+				return nil, fmt.Errorf("http.request() argument must be a map")
 			}
 
-			b, err := io.ReadAll(resp.Body)
+			var url string
+			if u, ok := params["url"]; ok {
+				url, _ = tengo.ToString(u)
+			}
+			if url == "" {
+				return nil, fmt.Errorf("http.request() needs a 'url'")
+			}
+
+			method := "GET"
+			if m, ok := params["method"]; ok {
+				method, _ = tengo.ToString(m)
+				method = strings.ToUpper(method)
+			}
+
+			var timeout time.Duration
+			if t, ok := params["timeout"]; ok {
+				secs, ok := tengo.ToFloat64(t)
+				if !ok {
+					return nil, fmt.Errorf("http.request() 'timeout' must be a number of seconds")
+				}
+				timeout = time.Duration(secs * float64(time.Second))
+			}
+
+			resp, err := doHttpRequest("http.request", method, url, params["headers"], params["body"], timeout)
 			if err != nil {
-				return nil, fmt.Errorf("http.get() failed to read response from '%s': %w", url.Value, err)
+				return nil, err
 			}
 
-			return &tengo.String{Value: strings.TrimSpace(string(b))}, nil
+			return &tengo.Map{
+				Value: map[string]tengo.Object{
+					"status":  &tengo.Int{Value: int64(resp.status)},
+					"headers": resp.tengoHeaders(),
+					"body":    resp.tengoBody(),
+				},
+			}, nil
 		}),
 	},
 }
+
+type httpResponse struct {
+	status      int
+	header      http.Header
+	body        []byte
+	cachedUntil time.Time
+}
+
+var (
+	httpCache      = make(map[string]*httpResponse)
+	httpCacheMutex sync.Mutex
+
+	httpSemaphore     chan struct{}
+	httpSemaphoreOnce sync.Once
+)
+
+func doHttpRequest(
+	fname string,
+	method string,
+	targetURL string,
+	headers tengo.Object,
+	body tengo.Object,
+	timeout time.Duration,
+) (*httpResponse, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s() got an invalid url '%s': %w", fname, targetURL, err)
+	}
+	if !isHostAllowed(u.Hostname()) {
+		metricHttpCalls.WithLabelValues(fname, "denied").Inc()
+		return nil, fmt.Errorf("%s() is not allowed to call '%s'", fname, u.Hostname())
+	}
+
+	var reqBody io.Reader
+	isJSON := false
+	switch b := body.(type) {
+	case nil, *tengo.Undefined:
+	case *tengo.String:
+		reqBody = strings.NewReader(b.Value)
+	case *tengo.Bytes:
+		reqBody = bytes.NewReader(b.Value)
+	default:
+		// copying turns event objects into maps, which the json encoder understands
+		j, err := json.Encode(body.Copy())
+		if err != nil {
+			return nil, fmt.Errorf("%s() failed to encode body as json: %w", fname, err)
+		}
+		reqBody = bytes.NewReader(j)
+		isJSON = true
+	}
+
+	// only http.get calls are cached
+	cacheable := s.HTTPCacheTTL > 0 && fname == "http.get"
+	if cacheable {
+		httpCacheMutex.Lock()
+		cached, ok := httpCache[targetURL]
+		httpCacheMutex.Unlock()
+		if ok && time.Now().Before(cached.cachedUntil) {
+			metricHttpCalls.WithLabelValues(fname, "cached").Inc()
+			return cached, nil
+		}
+	}
+
+	// the global timeout is also the upper bound for per-call timeouts
+	if timeout <= 0 || (s.HTTPTimeout > 0 && timeout > s.HTTPTimeout) {
+		timeout = s.HTTPTimeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("%s() failed to build request to '%s': %w", fname, targetURL, err)
+	}
+	if isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	switch h := headers.(type) {
+	case nil, *tengo.Undefined:
+	case *tengo.Map:
+		for k, v := range h.Value {
+			vs, _ := tengo.ToString(v)
+			req.Header.Set(k, vs)
+		}
+	case *tengo.ImmutableMap:
+		for k, v := range h.Value {
+			vs, _ := tengo.ToString(v)
+			req.Header.Set(k, vs)
+		}
+	default:
+		return nil, fmt.Errorf("%s() headers must be a map", fname)
+	}
+
+	httpSemaphoreOnce.Do(func() {
+		if s.HTTPMaxConcurrent > 0 {
+			httpSemaphore = make(chan struct{}, s.HTTPMaxConcurrent)
+		}
+	})
+	if httpSemaphore != nil {
+		select {
+		case httpSemaphore <- struct{}{}:
+			defer func() { <-httpSemaphore }()
+		case <-ctx.Done():
+			metricHttpCalls.WithLabelValues(fname, "error").Inc()
+			return nil, fmt.Errorf("%s() timed out waiting for other http calls to finish", fname)
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		metricHttpCalls.WithLabelValues(fname, "error").Inc()
+		return nil, fmt.Errorf("%s() failed to call '%s': %w", fname, targetURL, err)
+	}
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	if s.HTTPMaxResponseSize > 0 {
+		reader = io.LimitReader(resp.Body, s.HTTPMaxResponseSize+1)
+	}
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		metricHttpCalls.WithLabelValues(fname, "error").Inc()
+		return nil, fmt.Errorf("%s() failed to read response from '%s': %w", fname, targetURL, err)
+	}
+	if s.HTTPMaxResponseSize > 0 && int64(len(b)) > s.HTTPMaxResponseSize {
+		metricHttpCalls.WithLabelValues(fname, "error").Inc()
+		return nil, fmt.Errorf("%s() got a response bigger than %d bytes from '%s'", fname, s.HTTPMaxResponseSize, targetURL)
+	}
+
+	metricHttpCalls.WithLabelValues(fname, "ok").Inc()
+	res := &httpResponse{
+		status: resp.StatusCode,
+		header: resp.Header,
+		body:   b,
+	}
+
+	// errors are likely to go away soon, so they aren't kept
+	if cacheable && res.status >= 200 && res.status < 300 {
+		res.cachedUntil = time.Now().Add(s.HTTPCacheTTL)
+		httpCacheMutex.Lock()
+		httpCache[targetURL] = res
+		httpCacheMutex.Unlock()
+	}
+
+	return res, nil
+}
+
+var httpClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !isHostAllowed(req.URL.Hostname()) {
+			return fmt.Errorf("redirect to '%s' is not allowed", req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// isHostAllowed checks a hostname against the configured allowlist. entries can be
+// exact hostnames or "*.example.com" to match all subdomains of example.com
+func isHostAllowed(host string) bool {
+	if s.HTTPAllowedHosts == "" {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range strings.Split(s.HTTPAllowedHosts, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == host {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepHttpCache periodically removes expired responses from the cache
+func sweepHttpCache(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			httpCacheMutex.Lock()
+			for key, cached := range httpCache {
+				if now.After(cached.cachedUntil) {
+					delete(httpCache, key)
+				}
+			}
+			httpCacheMutex.Unlock()
+		}
+	}
+}
+
+func (resp *httpResponse) tengoHeaders() tengo.Object {
+	headers := make(map[string]tengo.Object, len(resp.header))
+	for k, v := range resp.header {
+		headers[strings.ToLower(k)] = &tengo.String{Value: strings.Join(v, ", ")}
+	}
+	return &tengo.Map{Value: headers}
+}
+
+// tengoBody turns json responses into tengo maps and arrays, everything else is
+// returned as a trimmed string
+func (resp *httpResponse) tengoBody() tengo.Object {
+	if strings.Contains(resp.header.Get("Content-Type"), "json") {
+		if o, err := json.Decode(resp.body); err == nil {
+			return o
+		}
+	}
+	return &tengo.String{Value: strings.TrimSpace(string(resp.body))}
+}
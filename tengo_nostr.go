@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/d5/tengo/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var tengoNostr = map[string]tengo.Object{
+	"verify": &tengo.UserFunction{
+		Name: "nostr.verify",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("nostr.verify() needs an argument")
+			}
+			event, err := eventFromTengo(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("nostr.verify() got an invalid event: %w", err)
+			}
+			if !event.CheckID() {
+				return tengo.FalseValue, nil
+			}
+			if ok, _ := event.CheckSignature(); !ok {
+				return tengo.FalseValue, nil
+			}
+			return tengo.TrueValue, nil
+		}),
+	},
+	"get_id": &tengo.UserFunction{
+		Name: "nostr.get_id",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("nostr.get_id() needs an argument")
+			}
+			event, err := eventFromTengo(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("nostr.get_id() got an invalid event: %w", err)
+			}
+			return &tengo.String{Value: event.GetID()}, nil
+		}),
+	},
+	"pow_difficulty": &tengo.UserFunction{
+		Name: "nostr.pow_difficulty",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 1 {
+				return nil, fmt.Errorf("nostr.pow_difficulty() needs an argument")
+			}
+			id, ok := args[0].(*tengo.String)
+			if !ok || len(id.Value) != 64 {
+				return nil, fmt.Errorf("nostr.pow_difficulty() argument must be a hex event id")
+			}
+			return &tengo.Int{Value: int64(nip13.Difficulty(id.Value))}, nil
+		}),
+	},
+	"tag_values": &tengo.UserFunction{
+		Name: "nostr.tag_values",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("nostr.tag_values() needs two arguments")
+			}
+			event, err := eventFromTengo(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("nostr.tag_values() got an invalid event: %w", err)
+			}
+			name, ok := args[1].(*tengo.String)
+			if !ok {
+				return nil, fmt.Errorf("nostr.tag_values() second argument must be a string")
+			}
+			values := make([]string, 0, len(event.Tags))
+			for _, tag := range event.Tags {
+				if len(tag) >= 2 && tag[0] == name.Value {
+					values = append(values, tag[1])
+				}
+			}
+			return stringSliceToTengo(values), nil
+		}),
+	},
+	"nip19": &tengo.ImmutableMap{
+		Value: map[string]tengo.Object{
+			"decode": &tengo.UserFunction{
+				Name:  "nostr.nip19.decode",
+				Value: tengo.CallableFunc(nip19Decode),
+			},
+			"encode": &tengo.UserFunction{
+				Name:  "nostr.nip19.encode",
+				Value: tengo.CallableFunc(nip19Encode),
+			},
+		},
+	},
+	"nip05": &tengo.ImmutableMap{
+		Value: map[string]tengo.Object{
+			"parse": &tengo.UserFunction{
+				Name: "nostr.nip05.parse",
+				Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+					if len(args) < 1 {
+						return nil, fmt.Errorf("nostr.nip05.parse() needs an argument")
+					}
+					identifier, ok := args[0].(*tengo.String)
+					if !ok {
+						return nil, fmt.Errorf("nostr.nip05.parse() argument must be a string")
+					}
+					name, domain, err := nip05.ParseIdentifier(identifier.Value)
+					if err != nil {
+						return &tengo.Undefined{}, nil
+					}
+					return &tengo.Map{
+						Value: map[string]tengo.Object{
+							"name":   &tengo.String{Value: name},
+							"domain": &tengo.String{Value: domain},
+						},
+					}, nil
+				}),
+			},
+		},
+	},
+}
+
+// nip19Decode returns a map with "type" set to the bech32 prefix and "data" set to either
+// a hex string (for npub, nsec and note) or a map with the pointer fields
+func nip19Decode(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("nostr.nip19.decode() needs an argument")
+	}
+	code, ok := args[0].(*tengo.String)
+	if !ok {
+		return nil, fmt.Errorf("nostr.nip19.decode() argument must be a string")
+	}
+
+	prefix, value, err := nip19.Decode(code.Value)
+	if err != nil {
+		return nil, fmt.Errorf("nostr.nip19.decode() failed to decode '%s': %w", code.Value, err)
+	}
+
+	var data tengo.Object
+	switch v := value.(type) {
+	case string:
+		data = &tengo.String{Value: v}
+	case nostr.ProfilePointer:
+		data = &tengo.Map{
+			Value: map[string]tengo.Object{
+				"pubkey": &tengo.String{Value: v.PublicKey},
+				"relays": stringSliceToTengo(v.Relays),
+			},
+		}
+	case nostr.EventPointer:
+		data = &tengo.Map{
+			Value: map[string]tengo.Object{
+				"id":     &tengo.String{Value: v.ID},
+				"relays": stringSliceToTengo(v.Relays),
+				"author": &tengo.String{Value: v.Author},
+				"kind":   &tengo.Int{Value: int64(v.Kind)},
+			},
+		}
+	case nostr.EntityPointer:
+		data = &tengo.Map{
+			Value: map[string]tengo.Object{
+				"pubkey":     &tengo.String{Value: v.PublicKey},
+				"kind":       &tengo.Int{Value: int64(v.Kind)},
+				"identifier": &tengo.String{Value: v.Identifier},
+				"relays":     stringSliceToTengo(v.Relays),
+			},
+		}
+	default:
+		return nil, fmt.Errorf("nostr.nip19.decode() doesn't support '%s'", prefix)
+	}
+
+	return &tengo.Map{
+		Value: map[string]tengo.Object{
+			"type": &tengo.String{Value: prefix},
+			"data": data,
+		},
+	}, nil
+}
+
+// nip19Encode takes a bech32 prefix and the data in the same format as returned by nip19Decode
+func nip19Encode(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("nostr.nip19.encode() needs two arguments")
+	}
+	prefix, ok := args[0].(*tengo.String)
+	if !ok {
+		return nil, fmt.Errorf("nostr.nip19.encode() first argument must be a string")
+	}
+
+	var code string
+	switch prefix.Value {
+	case "npub", "nsec", "note":
+		hex, ok := args[1].(*tengo.String)
+		if !ok {
+			return nil, fmt.Errorf("nostr.nip19.encode() data for '%s' must be a hex string", prefix.Value)
+		}
+		switch prefix.Value {
+		case "npub":
+			code, err = nip19.EncodePublicKey(hex.Value)
+		case "nsec":
+			code, err = nip19.EncodePrivateKey(hex.Value)
+		case "note":
+			code, err = nip19.EncodeNote(hex.Value)
+		}
+	case "nprofile", "nevent", "naddr":
+		var data map[string]tengo.Object
+		switch o := args[1].(type) {
+		case *tengo.Map:
+			data = o.Value
+		case *tengo.ImmutableMap:
+			data = o.Value
+		default:
+			return nil, fmt.Errorf("nostr.nip19.encode() data for '%s' must be a map", prefix.Value)
+		}
+
+		str := func(key string) string {
+			if o, ok := data[key]; ok {
+				v, _ := tengo.ToString(o)
+				return v
+			}
+			return ""
+		}
+		var relays []string
+		if o, ok := data["relays"]; ok {
+			relays, err = tengoSliceToString(o)
+			if err != nil {
+				return nil, fmt.Errorf("nostr.nip19.encode() got invalid relays: %w", err)
+			}
+		}
+
+		switch prefix.Value {
+		case "nprofile":
+			code, err = nip19.EncodeProfile(str("pubkey"), relays)
+		case "nevent":
+			code, err = nip19.EncodeEvent(str("id"), relays, str("author"))
+		case "naddr":
+			kind, _ := tengo.ToInt(data["kind"])
+			code, err = nip19.EncodeEntity(str("pubkey"), kind, str("identifier"), relays)
+		}
+	default:
+		return nil, fmt.Errorf("nostr.nip19.encode() doesn't support '%s'", prefix.Value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nostr.nip19.encode() failed to encode '%s': %w", prefix.Value, err)
+	}
+
+	return &tengo.String{Value: code}, nil
+}
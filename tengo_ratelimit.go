@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/puzpuzpuz/xsync/v2"
+)
+
+var tengoRatelimit = map[string]tengo.Object{
+	"allow": &tengo.UserFunction{
+		Name: "ratelimit.allow",
+		Value: tengo.CallableFunc(func(args ...tengo.Object) (ret tengo.Object, err error) {
+			if len(args) < 3 {
+				return nil, fmt.Errorf("ratelimit.allow() needs three arguments")
+			}
+			key, ok := tengo.ToString(args[0])
+			if !ok {
+				return nil, fmt.Errorf("ratelimit.allow() key must be a string")
+			}
+			rate, ok := tengo.ToFloat64(args[1])
+			if !ok || rate <= 0 {
+				return nil, fmt.Errorf("ratelimit.allow() rate must be a positive number")
+			}
+			burst, ok := tengo.ToFloat64(args[2])
+			if !ok || burst < 1 {
+				return nil, fmt.Errorf("ratelimit.allow() burst must be at least 1")
+			}
+			interval := 1.0
+			if len(args) > 3 {
+				interval, ok = tengo.ToFloat64(args[3])
+				if !ok || interval <= 0 {
+					return nil, fmt.Errorf("ratelimit.allow() interval must be a positive number of seconds")
+				}
+			}
+
+			if allowRate(key, rate/interval, burst) {
+				return tengo.TrueValue, nil
+			}
+			return tengo.FalseValue, nil
+		}),
+	},
+}
+
+// tokenBucket is only changed inside buckets.Compute, so it needs no lock of its own and
+// sweepBuckets can't delete a bucket that is being used
+type tokenBucket struct {
+	tokens float64
+	rate   float64 // tokens per second
+	burst  float64
+	last   time.Time
+}
+
+var buckets = xsync.NewMapOf[*tokenBucket]()
+
+// allowRate takes one token from the bucket at key, creating it full if it doesn't exist.
+// rate and burst are always updated so scripts can change their limits on the fly
+func allowRate(key string, rate float64, burst float64) bool {
+	now := time.Now()
+	allowed := false
+	buckets.Compute(key, func(bucket *tokenBucket, loaded bool) (*tokenBucket, bool) {
+		if !loaded {
+			bucket = &tokenBucket{tokens: burst, last: now}
+		}
+
+		bucket.rate = rate
+		bucket.burst = burst
+		bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+		bucket.last = now
+
+		if bucket.tokens >= 1 {
+			bucket.tokens--
+			allowed = true
+		}
+		return bucket, false
+	})
+	return allowed
+}
+
+// sweepBuckets periodically removes buckets that have refilled completely, since these
+// are the same as a new bucket
+func sweepBuckets(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			buckets.Range(func(key string, _ *tokenBucket) bool {
+				// checked again under the map lock, the bucket may have been used since
+				buckets.Compute(key, func(bucket *tokenBucket, loaded bool) (*tokenBucket, bool) {
+					full := loaded && bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate >= bucket.burst
+					return bucket, full
+				})
+				return true
+			})
+		}
+	}
+}
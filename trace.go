@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/puzpuzpuz/xsync/v2"
+)
+
+// how many evaluations are kept for each traced pubkey or ip
+const maxTraceEntries = 100
+
+// tracer records script evaluations involving a pubkey or an ip until it expires
+type tracer struct {
+	until   time.Time
+	entries []*traceEntry
+	mutex   sync.Mutex
+}
+
+// tracers are keyed by pubkey or ip
+var tracers = xsync.NewMapOf[*tracer]()
+
+type traceEntry struct {
+	Time     time.Time     `json:"time"`
+	Script   string        `json:"script"`
+	IP       string        `json:"ip"`
+	Authed   string        `json:"authed,omitempty"`
+	Event    *nostr.Event  `json:"event,omitempty"`
+	Filter   *nostr.Filter `json:"filter,omitempty"`
+	Calls    []*traceCall  `json:"calls"`
+	Decision string        `json:"decision"`
+	Message  string        `json:"message,omitempty"`
+	Duration float64       `json:"duration_ms"`
+
+	tracer *tracer
+	mutex  sync.Mutex
+}
+
+type traceCall struct {
+	Call   string `json:"call"`
+	Args   []any  `json:"args"`
+	Result any    `json:"result"`
+
+	// for queries, the number of events the script read
+	count *atomic.Int64
+}
+
+type traceKey struct{}
+
+// traceFor returns a context that will record what the script does if the authed pubkey,
+// the event author or the ip are being traced
+func traceFor(ctx context.Context, script scriptPath, event *nostr.Event, filter *nostr.Filter) (context.Context, *traceEntry) {
+	if tracers.Size() == 0 {
+		return ctx, nil
+	}
+
+	candidates := []string{khatru.GetAuthed(ctx), getIP(ctx)}
+	if event != nil {
+		candidates = append(candidates, event.PubKey)
+	}
+	for _, target := range candidates {
+		if target == "" {
+			continue
+		}
+		tr, ok := tracers.Load(target)
+		if !ok {
+			continue
+		}
+		if time.Now().After(tr.until) {
+			tracers.Delete(target)
+			continue
+		}
+
+		entry := &traceEntry{
+			Time:   time.Now(),
+			Script: string(script),
+			IP:     getIP(ctx),
+			Authed: khatru.GetAuthed(ctx),
+			Event:  event,
+			Filter: filter,
+			Calls:  make([]*traceCall, 0, 4),
+			tracer: tr,
+		}
+		return context.WithValue(ctx, traceKey{}, entry), entry
+	}
+
+	return ctx, nil
+}
+
+func getTrace(ctx context.Context) *traceEntry {
+	entry, _ := ctx.Value(traceKey{}).(*traceEntry)
+	return entry
+}
+
+func (entry *traceEntry) record(call string, args []tengo.Object, result any) *traceCall {
+	tc := &traceCall{Call: call, Args: make([]any, len(args)), Result: result}
+	for i, arg := range args {
+		tc.Args[i] = tengo.ToInterface(arg.Copy())
+	}
+	entry.mutex.Lock()
+	entry.Calls = append(entry.Calls, tc)
+	entry.mutex.Unlock()
+	return tc
+}
+
+// finish must be called once a reject script is done, it adds the entry to its tracer
+func (entry *traceEntry) finish(start time.Time, reject bool, msg string) {
+	decision := "accept"
+	if reject {
+		decision = "reject"
+	}
+	entry.finishWith(start, decision, msg)
+}
+
+// finishWith is finish for scripts that decide something else, like where an event goes
+func (entry *traceEntry) finishWith(start time.Time, decision string, msg string) {
+	entry.mutex.Lock()
+	for _, tc := range entry.Calls {
+		if tc.count != nil {
+			tc.Result = tc.count.Load()
+		}
+	}
+	entry.Decision = decision
+	entry.Message = msg
+	entry.Duration = float64(time.Since(start).Microseconds()) / 1000
+	entry.mutex.Unlock()
+
+	tr := entry.tracer
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if len(tr.entries) >= maxTraceEntries {
+		tr.entries = tr.entries[1:]
+	}
+	tr.entries = append(tr.entries, entry)
+}
+
+// traceQuery records a query made by a script and counts the events it reads from it
+func traceQuery(ctx context.Context, fname string, filter nostr.Filter, ch chan *nostr.Event) chan *nostr.Event {
+	entry := getTrace(ctx)
+	if entry == nil {
+		return ch
+	}
+
+	tc := entry.record("relay."+fname, []tengo.Object{filterToTengo(filter)}, nil)
+	tc.count = &atomic.Int64{}
+
+	counted := make(chan *nostr.Event)
+	go func() {
+		defer close(counted)
+		for evt := range ch {
+			select {
+			case counted <- evt:
+				tc.count.Add(1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return counted
+}
+
+// traceStore records all calls to a store object if the script is being traced
+func traceStore(ctx context.Context, name string, obj tengo.Object) tengo.Object {
+	entry := getTrace(ctx)
+	m, ok := obj.(*tengo.Map)
+	if entry == nil || !ok {
+		return obj
+	}
+
+	traced := make(map[string]tengo.Object, len(m.Value))
+	for fname, value := range m.Value {
+		fn, ok := value.(*tengo.UserFunction)
+		if !ok {
+			traced[fname] = value
+			continue
+		}
+		call := name + "." + fname
+		traced[fname] = &tengo.UserFunction{
+			Name: fn.Name,
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				res, err := fn.Value(args...)
+				if err != nil {
+					entry.record(call, args, "error: "+err.Error())
+				} else if res == nil {
+					entry.record(call, args, nil)
+				} else {
+					entry.record(call, args, tengo.ToInterface(res.Copy()))
+				}
+				return res, err
+			},
+		}
+	}
+	return &tengo.Map{Value: traced}
+}
+
+// sweepTracers periodically removes the tracers that expired, so what they recorded doesn't
+// stay in memory until someone tries to read it
+func sweepTracers(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tracers.Range(func(target string, tr *tracer) bool {
+				if now.After(tr.until) {
+					tracers.Delete(target)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// startTracing starts or restarts tracing a pubkey or ip, dropping what was recorded before
+func startTracing(target string, duration time.Duration) {
+	tracers.Store(target, &tracer{until: time.Now().Add(duration)})
+}
+
+// traceEntries returns what was recorded for a target, or nil if it isn't being traced
+func traceEntries(target string) []*traceEntry {
+	tr, ok := tracers.Load(target)
+	if !ok {
+		return nil
+	}
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return append(make([]*traceEntry, 0, len(tr.entries)), tr.entries...)
+}
@@ -2,12 +2,18 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 func eventToTengo(event *nostr.Event) tengo.Object {
+	return &EventObject{event: event}
+}
+
+func eventToMap(event *nostr.Event) *tengo.Map {
 	return &tengo.Map{
 		Value: map[string]tengo.Object{
 			"id":         &tengo.String{Value: event.ID},
@@ -21,6 +27,49 @@ func eventToTengo(event *nostr.Event) tengo.Object {
 	}
 }
 
+func eventFromTengo(e tengo.Object) (*nostr.Event, error) {
+	if eo, ok := e.(*EventObject); ok {
+		event := *eo.event
+		return &event, nil
+	}
+
+	tmap, err := tengoToMap(e)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &nostr.Event{}
+	for key, value := range tmap {
+		switch key {
+		case "id":
+			event.ID, err = tengoToString(value)
+		case "pubkey":
+			event.PubKey, err = tengoToString(value)
+		case "sig":
+			event.Sig, err = tengoToString(value)
+		case "content":
+			event.Content, err = tengoToString(value)
+		case "kind":
+			var kind int64
+			kind, err = tengoToInt(value)
+			event.Kind = int(kind)
+		case "created_at":
+			var createdAt int64
+			createdAt, err = tengoToInt(value)
+			event.CreatedAt = nostr.Timestamp(createdAt)
+		case "tags":
+			event.Tags, err = tagsFromTengo(value)
+		default:
+			return nil, fmt.Errorf("unknown event field '%s'", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event '%s': %w", key, err)
+		}
+	}
+
+	return event, nil
+}
+
 func tagsToTengo(tags nostr.Tags) tengo.Object {
 	ttags := make([]tengo.Object, len(tags))
 	for t, tag := range tags {
@@ -29,6 +78,23 @@ func tagsToTengo(tags nostr.Tags) tengo.Object {
 	return &tengo.Array{Value: ttags}
 }
 
+func tagsFromTengo(v tengo.Object) (nostr.Tags, error) {
+	ttags, err := tengoToSlice(v)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(nostr.Tags, len(ttags))
+	for t, ttag := range ttags {
+		tag, err := tengoSliceToString(ttag)
+		if err != nil {
+			return nil, fmt.Errorf("tag %d: %w", t, err)
+		}
+		tags[t] = tag
+	}
+	return tags, nil
+}
+
 func stringSliceToTengo(ss []string) tengo.Object {
 	tss := make([]tengo.Object, len(ss))
 	for i, item := range ss {
@@ -48,19 +114,19 @@ func intSliceToTengo(ss []int) tengo.Object {
 func filterToTengo(filter nostr.Filter) tengo.Object {
 	f := make(map[string]tengo.Object, 8)
 
-	if len(filter.IDs) > 0 {
+	if filter.IDs != nil {
 		f["ids"] = stringSliceToTengo(filter.IDs)
 	}
-	if len(filter.Authors) > 0 {
+	if filter.Authors != nil {
 		f["authors"] = stringSliceToTengo(filter.Authors)
 	}
-	if len(filter.Kinds) > 0 {
+	if filter.Kinds != nil {
 		f["kinds"] = intSliceToTengo(filter.Kinds)
 	}
 	for tag, values := range filter.Tags {
 		f["#"+tag] = stringSliceToTengo(values)
 	}
-	if filter.Limit > 0 {
+	if filter.Limit > 0 || filter.LimitZero {
 		f["limit"] = &tengo.Int{Value: int64(filter.Limit)}
 	}
 	if filter.Since != nil {
@@ -78,20 +144,11 @@ func filterToTengo(filter nostr.Filter) tengo.Object {
 
 func filterFromTengo(f tengo.Object) (nostr.Filter, error) {
 	filter := nostr.Filter{}
-	var tmap map[string]tengo.Object
-
-	switch o := f.(type) {
-	case *tengo.Map:
-		tmap = o.Value
-	case *tengo.ImmutableMap:
-		tmap = o.Value
-	default:
-		return filter, fmt.Errorf("%v is not a map", f)
+	tmap, err := tengoToMap(f)
+	if err != nil {
+		return filter, err
 	}
 
-	filter.Tags = make(nostr.TagMap)
-	var err error
-
 	for key, value := range tmap {
 		switch key {
 		case "ids":
@@ -101,62 +158,116 @@ func filterFromTengo(f tengo.Object) (nostr.Filter, error) {
 		case "kinds":
 			filter.Kinds, err = tengoSliceToInt(value)
 		case "limit":
-			filter.Limit = int(value.(*tengo.Int).Value)
-			if filter.Limit == 0 {
-				filter.LimitZero = true
+			var limit int64
+			limit, err = tengoToInt(value)
+			if err == nil && limit < 0 {
+				err = fmt.Errorf("can't be negative")
 			}
+			filter.Limit = int(limit)
+			filter.LimitZero = limit == 0
 		case "since":
-			v := nostr.Timestamp(value.(*tengo.Int).Value)
-			filter.Since = &v
+			var since int64
+			since, err = tengoToInt(value)
+			filter.Since = (*nostr.Timestamp)(&since)
 		case "until":
-			v := nostr.Timestamp(value.(*tengo.Int).Value)
-			filter.Until = &v
+			var until int64
+			until, err = tengoToInt(value)
+			filter.Until = (*nostr.Timestamp)(&until)
+		case "search":
+			filter.Search, err = tengoToString(value)
 		default:
-			if key[0] == '#' {
-				filter.Tags[key[1:]], err = tengoSliceToString(value)
+			tag, ok := strings.CutPrefix(key, "#")
+			if !ok || tag == "" {
+				return filter, fmt.Errorf("unknown filter field '%s'", key)
+			}
+			if filter.Tags == nil {
+				filter.Tags = make(nostr.TagMap)
 			}
+			filter.Tags[tag], err = tengoSliceToString(value)
+		}
+		if err != nil {
+			return filter, fmt.Errorf("filter '%s': %w", key, err)
 		}
 	}
 
-	return filter, err
+	return filter, nil
 }
 
 func tengoSliceToString(v tengo.Object) ([]string, error) {
-	var tss []tengo.Object
-
-	switch v.(type) {
-	case *tengo.Array:
-		tss = v.(*tengo.Array).Value
-	case *tengo.ImmutableArray:
-		tss = v.(*tengo.Array).Value
-	default:
-		return nil, fmt.Errorf("%v is not an array", v)
+	tss, err := tengoToSlice(v)
+	if err != nil {
+		return nil, err
 	}
 
 	ss := make([]string, len(tss))
 	for i, o := range tss {
-		ss[i] = o.(*tengo.String).Value
+		s, ok := o.(*tengo.String)
+		if !ok {
+			return nil, fmt.Errorf("item %d must be a string, not %s", i, o.TypeName())
+		}
+		ss[i] = s.Value
 	}
 	return ss, nil
 }
 
 func tengoSliceToInt(v tengo.Object) ([]int, error) {
-	var tss []tengo.Object
+	tss, err := tengoToSlice(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := make([]int, len(tss))
+	for i, o := range tss {
+		n, ok := o.(*tengo.Int)
+		if !ok {
+			return nil, fmt.Errorf("item %d must be an int, not %s", i, o.TypeName())
+		}
+		ss[i] = int(n.Value)
+	}
+	return ss, nil
+}
 
-	switch v.(type) {
+// tengoToSlice accepts both mutable and immutable arrays
+func tengoToSlice(v tengo.Object) ([]tengo.Object, error) {
+	switch o := v.(type) {
 	case *tengo.Array:
-		tss = v.(*tengo.Array).Value
+		return o.Value, nil
 	case *tengo.ImmutableArray:
-		tss = v.(*tengo.Array).Value
+		return o.Value, nil
 	default:
-		return nil, fmt.Errorf("%v is not an array", v)
+		return nil, fmt.Errorf("must be an array, not %s", v.TypeName())
 	}
+}
 
-	ss := make([]int, len(tss))
-	for i, o := range tss {
-		ss[i] = int(o.(*tengo.Int).Value)
+// tengoToMap accepts both mutable and immutable maps
+func tengoToMap(v tengo.Object) (map[string]tengo.Object, error) {
+	switch o := v.(type) {
+	case *tengo.Map:
+		return o.Value, nil
+	case *tengo.ImmutableMap:
+		return o.Value, nil
+	default:
+		return nil, fmt.Errorf("must be a map, not %s", v.TypeName())
 	}
-	return ss, nil
+}
+
+// tengoToString and tengoToInt don't do any of the conversions tengo.ToString and
+// tengo.ToInt do, so a script that passes the wrong type gets an error instead of a
+// surprising value
+func tengoToString(v tengo.Object) (string, error) {
+	s, ok := v.(*tengo.String)
+	if !ok {
+		return "", fmt.Errorf("must be a string, not %s", v.TypeName())
+	}
+	return s.Value, nil
+}
+
+func tengoToInt(v tengo.Object) (int64, error) {
+	i, ok := v.(*tengo.Int)
+	if !ok {
+		return 0, fmt.Errorf("must be an int, not %s", v.TypeName())
+	}
+	return i.Value, nil
 }
 
 type EventIteratorWrapper struct {
@@ -196,3 +307,193 @@ func (ei *EventIterator) Next() bool {
 }
 func (ei EventIterator) Key() tengo.Object   { return &tengo.Int{Value: int64(ei.i - 1)} }
 func (ei EventIterator) Value() tengo.Object { return eventToTengo(ei.next) }
+
+// EventObject is what scripts get instead of a map for each event, fields are only turned
+// into tengo objects when they are accessed, and only once
+type EventObject struct {
+	tengo.ObjectImpl
+	event  *nostr.Event
+	fields map[string]tengo.Object
+}
+
+func (eo *EventObject) String() string   { return eo.event.String() }
+func (eo *EventObject) TypeName() string { return "event" }
+func (eo *EventObject) IsFalsy() bool    { return false }
+func (eo *EventObject) CanIterate() bool { return true }
+func (eo *EventObject) Iterate() tengo.Iterator {
+	return eventToMap(eo.event).Iterate()
+}
+
+func (eo *EventObject) Equals(another tengo.Object) bool {
+	o, ok := another.(*EventObject)
+	return ok && o.event.ID == eo.event.ID
+}
+
+// Copy returns a regular map, so scripts can modify it (and encode it as json)
+func (eo *EventObject) Copy() tengo.Object { return eventToMap(eo.event) }
+
+func (eo *EventObject) IndexGet(index tengo.Object) (tengo.Object, error) {
+	key, ok := index.(*tengo.String)
+	if !ok {
+		return nil, tengo.ErrInvalidIndexType
+	}
+
+	if value, ok := eo.fields[key.Value]; ok {
+		return value, nil
+	}
+
+	var value tengo.Object
+	switch key.Value {
+	case "id":
+		value = &tengo.String{Value: eo.event.ID}
+	case "pubkey":
+		value = &tengo.String{Value: eo.event.PubKey}
+	case "sig":
+		value = &tengo.String{Value: eo.event.Sig}
+	case "content":
+		value = &tengo.String{Value: eo.event.Content}
+	case "kind":
+		value = &tengo.Int{Value: int64(eo.event.Kind)}
+	case "created_at":
+		value = &tengo.Int{Value: int64(eo.event.CreatedAt)}
+	case "tags":
+		// immutable like the event, otherwise changes would be lost the next time it's read
+		tags := make([]tengo.Object, len(eo.event.Tags))
+		for t, tag := range eo.event.Tags {
+			items := make([]tengo.Object, len(tag))
+			for i, item := range tag {
+				items[i] = &tengo.String{Value: item}
+			}
+			tags[t] = &tengo.ImmutableArray{Value: items}
+		}
+		value = &tengo.ImmutableArray{Value: tags}
+	}
+	if value != nil {
+		if eo.fields == nil {
+			eo.fields = make(map[string]tengo.Object, 4)
+		}
+		eo.fields[key.Value] = value
+		return value, nil
+	}
+
+	switch key.Value {
+	case "tag":
+		return &tengo.UserFunction{
+			Name: "tag",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				name, err := tagNameFromArgs("tag", args)
+				if err != nil {
+					return nil, err
+				}
+				for _, tag := range eo.event.Tags {
+					if len(tag) >= 1 && tag[0] == name {
+						return stringSliceToTengo(tag), nil
+					}
+				}
+				return &tengo.Undefined{}, nil
+			},
+		}, nil
+	case "tags_by":
+		return &tengo.UserFunction{
+			Name: "tags_by",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				name, err := tagNameFromArgs("tags_by", args)
+				if err != nil {
+					return nil, err
+				}
+				tags := make([]tengo.Object, 0, 4)
+				for _, tag := range eo.event.Tags {
+					if len(tag) >= 1 && tag[0] == name {
+						tags = append(tags, stringSliceToTengo(tag))
+					}
+				}
+				return &tengo.Array{Value: tags}, nil
+			},
+		}, nil
+	}
+
+	return &tengo.Undefined{}, nil
+}
+
+func tagNameFromArgs(fname string, args []tengo.Object) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("%s function requires an argument", fname)
+	}
+	name, ok := args[0].(*tengo.String)
+	if !ok {
+		return "", fmt.Errorf("%s function argument must be a string", fname)
+	}
+	return name.Value, nil
+}
+
+// scripts got events as maps before EventObject, so they still pass as maps for is_map()
+// and json.encode(), see tengoJSON
+func init() {
+	for _, fn := range tengo.GetAllBuiltinFunctions() {
+		if fn.Name != "is_map" {
+			continue
+		}
+		isMap := fn.Value
+		fn.Value = func(args ...tengo.Object) (tengo.Object, error) {
+			if len(args) == 1 {
+				if _, ok := args[0].(*EventObject); ok {
+					return tengo.TrueValue, nil
+				}
+			}
+			return isMap(args...)
+		}
+	}
+}
+
+// tengoJSON is the json module from the stdlib, but encode() takes event objects as the maps
+// they stand for, it would ignore them otherwise
+var tengoJSON = func() map[string]tengo.Object {
+	module := make(map[string]tengo.Object, len(stdlib.BuiltinModules["json"]))
+	for name, fn := range stdlib.BuiltinModules["json"] {
+		module[name] = fn
+	}
+	encode := module["encode"].(*tengo.UserFunction).Value
+	module["encode"] = &tengo.UserFunction{
+		Name: "encode",
+		Value: func(args ...tengo.Object) (tengo.Object, error) {
+			if len(args) == 1 {
+				args = []tengo.Object{withEventMaps(args[0])}
+			}
+			return encode(args...)
+		},
+	}
+	return module
+}()
+
+// withEventMaps replaces the event objects in o, and in the arrays and maps inside it, with maps
+func withEventMaps(o tengo.Object) tengo.Object {
+	items := func(values []tengo.Object) []tengo.Object {
+		replaced := make([]tengo.Object, len(values))
+		for i, v := range values {
+			replaced[i] = withEventMaps(v)
+		}
+		return replaced
+	}
+	fields := func(values map[string]tengo.Object) map[string]tengo.Object {
+		replaced := make(map[string]tengo.Object, len(values))
+		for k, v := range values {
+			replaced[k] = withEventMaps(v)
+		}
+		return replaced
+	}
+
+	switch v := o.(type) {
+	case *EventObject:
+		return v.Copy()
+	case *tengo.Array:
+		return &tengo.Array{Value: items(v.Value)}
+	case *tengo.ImmutableArray:
+		return &tengo.ImmutableArray{Value: items(v.Value)}
+	case *tengo.Map:
+		return &tengo.Map{Value: fields(v.Value)}
+	case *tengo.ImmutableMap:
+		return &tengo.ImmutableMap{Value: fields(v.Value)}
+	default:
+		return o
+	}
+}
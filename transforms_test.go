@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/d5/tengo/v2"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// tengoValue evaluates a tengo expression
+func tengoValue(t *testing.T, expr string) tengo.Object {
+	t.Helper()
+	compiled, err := tengo.NewScript([]byte("v := " + expr)).Run()
+	if err != nil {
+		t.Fatalf("invalid expression %s: %s", expr, err)
+	}
+	return compiled.Get("v").Object()
+}
+
+func TestFilterFromTengo(t *testing.T) {
+	ts := func(n nostr.Timestamp) *nostr.Timestamp { return &n }
+
+	for _, tc := range []struct {
+		expr   string
+		filter nostr.Filter
+		err    string
+	}{
+		{
+			expr: `{ids: ["a"], authors: ["b", "c"], kinds: [1, 7], "#e": ["x"], limit: 10, since: 5, until: 6, search: "s"}`,
+			filter: nostr.Filter{
+				IDs:     []string{"a"},
+				Authors: []string{"b", "c"},
+				Kinds:   []int{1, 7},
+				Tags:    nostr.TagMap{"e": []string{"x"}},
+				Limit:   10,
+				Since:   ts(5),
+				Until:   ts(6),
+				Search:  "s",
+			},
+		},
+		{expr: `{}`, filter: nostr.Filter{}},
+		{expr: `{limit: 0}`, filter: nostr.Filter{LimitZero: true}},
+		{expr: `immutable({authors: ["a"], "#p": ["b"]})`, filter: nostr.Filter{Authors: []string{"a"}, Tags: nostr.TagMap{"p": []string{"b"}}}},
+		{expr: `{kinds: immutable([1])}`, filter: nostr.Filter{Kinds: []int{1}}},
+		{expr: `{kinds: ["1"]}`, err: "filter 'kinds': item 0 must be an int"},
+		{expr: `{ids: "a"}`, err: "filter 'ids': must be an array"},
+		{expr: `{ids: [1]}`, err: "filter 'ids': item 0 must be a string"},
+		{expr: `{limit: -1}`, err: "filter 'limit': can't be negative"},
+		{expr: `{since: "1"}`, err: "filter 'since': must be an int"},
+		{expr: `{foo: 1}`, err: "unknown filter field 'foo'"},
+		{expr: `{"#": ["x"]}`, err: "unknown filter field '#'"},
+		{expr: `[1]`, err: "must be a map"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			filter, err := filterFromTengo(tengoValue(t, tc.expr))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with '%s', got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(filter, tc.filter) {
+				t.Fatalf("expected %v, got %v", tc.filter, filter)
+			}
+
+			// and back
+			again, err := filterFromTengo(filterToTengo(filter))
+			if err != nil {
+				t.Fatalf("filterToTengo gave an invalid filter: %s", err)
+			}
+			if !reflect.DeepEqual(again, tc.filter) {
+				t.Fatalf("expected %v after filterToTengo, got %v", tc.filter, again)
+			}
+		})
+	}
+}
+
+func TestEventFromTengo(t *testing.T) {
+	for _, tc := range []struct {
+		expr  string
+		event nostr.Event
+		err   string
+	}{
+		{
+			expr:  `{kind: 1, content: "hi", tags: [["e", "x", "wss://r"], ["t", "y"]], created_at: 10}`,
+			event: nostr.Event{Kind: 1, Content: "hi", Tags: nostr.Tags{{"e", "x", "wss://r"}, {"t", "y"}}, CreatedAt: 10},
+		},
+		{
+			expr:  `{id: "i", pubkey: "p", sig: "s", kind: 0, tags: []}`,
+			event: nostr.Event{ID: "i", PubKey: "p", Sig: "s", Kind: 0, Tags: nostr.Tags{}},
+		},
+		{
+			expr:  `immutable({kind: 7, tags: [["p", "y"]]})`,
+			event: nostr.Event{Kind: 7, Tags: nostr.Tags{{"p", "y"}}},
+		},
+		{expr: `{kind: "1"}`, err: "event 'kind': must be an int"},
+		{expr: `{created_at: 1.5}`, err: "event 'created_at': must be an int"},
+		{expr: `{content: 1}`, err: "event 'content': must be a string"},
+		{expr: `{tags: ["e"]}`, err: "event 'tags': tag 0: must be an array"},
+		{expr: `{tags: [["e", 1]]}`, err: "event 'tags': tag 0: item 1 must be a string"},
+		{expr: `{foo: 1}`, err: "unknown event field 'foo'"},
+		{expr: `"event"`, err: "must be a map"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			event, err := eventFromTengo(tengoValue(t, tc.expr))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with '%s', got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(*event, tc.event) {
+				t.Fatalf("expected %v, got %v", tc.event, *event)
+			}
+
+			// and back, both as an event object and as a map
+			for _, o := range []tengo.Object{eventToTengo(event), eventToMap(event)} {
+				again, err := eventFromTengo(o)
+				if err != nil {
+					t.Fatalf("unexpected error converting back from %s: %s", o.TypeName(), err)
+				}
+				if !reflect.DeepEqual(*again, tc.event) {
+					t.Fatalf("expected %v after converting back from %s, got %v", tc.event, o.TypeName(), *again)
+				}
+				if again == event {
+					t.Fatalf("converting back from %s didn't copy the event", o.TypeName())
+				}
+			}
+		})
+	}
+}
+
+func TestEventObject(t *testing.T) {
+	event := &nostr.Event{
+		ID:        "i",
+		PubKey:    "p",
+		Kind:      1,
+		CreatedAt: 10,
+		Content:   "hi",
+		Tags:      nostr.Tags{{"e", "a"}, {"p", "b"}, {"e", "c"}},
+	}
+
+	for _, tc := range []struct {
+		expr     string
+		expected string
+	}{
+		{`event.kind + 1`, `2`},
+		{`event.created_at`, `10`},
+		{`event.pubkey + event.id`, `"pi"`},
+		{`event.tags`, `[["e", "a"], ["p", "b"], ["e", "c"]]`},
+		{`is_immutable_array(event.tags) && is_immutable_array(event.tags[0])`, `true`},
+		{`event.tags == event.tags`, `true`},
+		{`event.tag("e")`, `["e", "a"]`},
+		{`event.tag("x")`, `<undefined>`},
+		{`event.tags_by("e")`, `[["e", "a"], ["e", "c"]]`},
+		{`event.nothing`, `<undefined>`},
+		{`is_map(copy(event)) && copy(event).content == "hi"`, `true`},
+		{`is_map(event) && !is_map(1)`, `true`},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			script := tengo.NewScript([]byte("v := " + tc.expr))
+			script.Add("event", eventToTengo(event))
+			compiled, err := script.Run()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if v := compiled.Get("v").Object().String(); v != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, v)
+			}
+		})
+	}
+
+	// json.encode() sees them as maps, even inside other values
+	script := tengo.NewScript([]byte(`json := import("json"); a := json.encode(event); b := json.encode([event, {e: immutable([event])}])`))
+	script.SetImports(makeModules(nil))
+	script.Add("event", eventToTengo(event))
+	compiled, err := script.Run()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sameEvent := func(evt nostr.Event) bool {
+		return evt.ID == event.ID && evt.Sig == event.Sig && bytes.Equal(evt.Serialize(), event.Serialize())
+	}
+	var a nostr.Event
+	if err := stdjson.Unmarshal(compiled.Get("a").Bytes(), &a); err != nil || !sameEvent(a) {
+		t.Fatalf("expected json.encode(event) to give the event, got %s (%v)", compiled.Get("a").Bytes(), err)
+	}
+	var b []stdjson.RawMessage
+	var inner map[string][]nostr.Event
+	if err := stdjson.Unmarshal(compiled.Get("b").Bytes(), &b); err != nil || len(b) != 2 ||
+		stdjson.Unmarshal(b[0], &a) != nil || !sameEvent(a) ||
+		stdjson.Unmarshal(b[1], &inner) != nil || len(inner["e"]) != 1 || !sameEvent(inner["e"][0]) {
+		t.Fatalf("expected json.encode() to encode events inside other values, got %s", compiled.Get("b").Bytes())
+	}
+
+	// tags can't be changed in place
+	script = tengo.NewScript([]byte(`event.tags[0][1] = "z"`))
+	script.Add("event", eventToTengo(event))
+	if _, err := script.Run(); err == nil {
+		t.Fatalf("expected an error changing a tag")
+	}
+}